@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -13,29 +14,90 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
+// stdio is the path standing for stdout as the output and stdin as the request
+const stdio = "-"
+
+// errNoOutput is reported when no layer sets the output path
+var errNoOutput = fmt.Errorf("output path is required; use -o or --output, or set output in the config file")
+
+// diag receives progress and diagnostics, switched to stderr when the output itself goes to stdout
+var diag io.Writer = os.Stdout
+
 func main() {
 	// Define command-line flags
+	var profileFlag string
 	var configFlag, directoryFlag, outputFlag, prepromptFlag, generateConfigFlag string
-	var tokenLimitFlag int
-	var skipFlags []string
-	var requestFlag string
+	var tokenLimitFlag, lineNumberWidthFlag int
+	var skipFlags, includeFlags, priorityFlags []string
+	var requestFlag, requestFileFlag, tokenizerFlag, formatFlag string
+	var gitTrackedFlag, gitUntrackedFlag bool
+	var reportFlag, packFlag, splitFlag bool
+	var reportFormatFlag, packPolicyFlag, lineNumberSeparatorFlag string
+	var lineNumbersFlag, skeletonFlag, stripCommentsFlag bool
+	var secretsFlag string
+	var noRedactFlag bool
+	var sinceFlag string
+	var stagedFlag, worktreeFlag, includeDiffFlag bool
+	var noGitignoreFlag, noNestedGitignoreFlag, noGitExcludeFlag, noGlobalExcludesFlag bool
+	var noSensitiveDefaultsFlag, explainFlag, dryRunFlag bool
 
 	flag.StringVarP(&configFlag, "config", "c", "", "Path to config YAML file.")
+	flag.StringVar(&profileFlag, "profile", "", "Named profile from the config file to apply.")
 	flag.StringVarP(&directoryFlag, "directory", "d", "", "Directory to process.")
 	flag.IntVarP(&tokenLimitFlag, "tokens", "t", 0, "Context/token limit.")
-	flag.StringVarP(&outputFlag, "output", "o", "", "Output file path (relative or absolute).")
+	flag.StringVar(&tokenizerFlag, "tokenizer", "", "Tokenizer used to count tokens: heuristic (default), cl100k_base or o200k_base.")
+	flag.StringVarP(&outputFlag, "output", "o", "", "Output file path (relative or absolute), or - for stdout.")
+	flag.StringVarP(&formatFlag, "format", "f", "", "Output format: text (default), markdown, xml, json or jsonl.")
 	flag.StringSliceVarP(&skipFlags, "skip", "s", []string{}, "Files or directories to omit.")
+	flag.StringSliceVarP(&includeFlags, "include", "i", []string{}, "Only include files matching these patterns.")
 	flag.StringVarP(&prepromptFlag, "preprompt", "p", "", "Preprompt message to prepend to the output.")
 	flag.StringVarP(&generateConfigFlag, "generate-config", "g", "", "Generate a default config file at the specified path.")
-	flag.StringVarP(&requestFlag, "request", "r", "", "Request to include in the preprompt.")
+	flag.StringVarP(&requestFlag, "request", "r", "", "Request to include in the preprompt, or - to read it from stdin.")
+	flag.StringVar(&requestFileFlag, "request-file", "", "File to read the request from.")
+	flag.StringVar(&secretsFlag, "secrets", "", "What to do with files containing possible secrets: redact (default), skip or abort.")
+	flag.BoolVar(&noRedactFlag, "no-redact", false, "Do not scan for secrets; write file contents as they are.")
+	flag.BoolVar(&skeletonFlag, "skeleton", false, "Reduce Go files to declarations and signatures, eliding function bodies.")
+	flag.BoolVar(&stripCommentsFlag, "strip-comments", false, "Remove comments and collapse blank lines in common languages.")
+	flag.BoolVarP(&lineNumbersFlag, "line-numbers", "n", false, "Prefix each line of file contents with its line number.")
+	flag.IntVar(&lineNumberWidthFlag, "line-number-width", 0, "Minimum width line numbers are right-aligned to.")
+	flag.StringVar(&lineNumberSeparatorFlag, "line-number-separator", "", "Text between line numbers and lines (default \" | \").")
+	flag.BoolVar(&packFlag, "pack", false, "Drop lower-priority files so the output fits within the token limit.")
+	flag.StringVar(&packPolicyFlag, "pack-policy", "", "Order files are packed in: priority (default), smallest, recent or request.")
+	flag.StringSliceVar(&priorityFlags, "priority", []string{}, "Patterns whose files are packed first, in order.")
+	flag.BoolVar(&splitFlag, "split", false, "Split output exceeding the token limit into numbered part files.")
+	flag.BoolVar(&reportFlag, "report", false, "Print a per-file and per-directory token breakdown.")
+	flag.StringVar(&reportFormatFlag, "report-format", "", "Report format: text (default) or json.")
+	flag.BoolVar(&gitTrackedFlag, "git-tracked", false, "Only include files tracked in the git index.")
+	flag.BoolVar(&gitUntrackedFlag, "git-untracked", false, "With --git-tracked, also include untracked files that are not ignored.")
+	flag.StringVar(&sinceFlag, "since", "", "Only include files changed since the merge base of this git ref and HEAD.")
+	flag.BoolVar(&stagedFlag, "staged", false, "Only include files with staged changes.")
+	flag.BoolVar(&worktreeFlag, "worktree", false, "Only include files with unstaged changes.")
+	flag.BoolVar(&includeDiffFlag, "include-diff", false, "Append the unified diff after the file contents.")
+	flag.BoolVar(&noGitignoreFlag, "no-gitignore", false, "Do not read any .gitignore files.")
+	flag.BoolVar(&noNestedGitignoreFlag, "no-nested-gitignore", false, "Only read the .gitignore in the processed directory.")
+	flag.BoolVar(&noGitExcludeFlag, "no-git-exclude", false, "Do not read .git/info/exclude.")
+	flag.BoolVar(&noGlobalExcludesFlag, "no-global-excludes", false, "Do not read the global excludes file from git config.")
+	flag.BoolVar(&noSensitiveDefaultsFlag, "no-sensitive-defaults", false, "Do not skip files that commonly hold credentials (.env, *.pem, id_rsa, ...).")
+	flag.BoolVar(&explainFlag, "explain", false, "Print why each path was selected or skipped to stderr.")
+	flag.BoolVar(&explainFlag, "verbose-selection", false, "Same as --explain.")
+	flag.BoolVar(&dryRunFlag, "dry-run", false, "List the selected files with sizes and tokens without writing output.")
 	flag.Parse()
+	checkIgnore := flag.Arg(0) == "check-ignore"
 
-	// Show help if no arguments provided
-	if flag.NFlag() == 0 {
-		flag.PrintDefaults()
-		os.Exit(0)
+	routeDiag(outputFlag)
+	if flag.Arg(0) == "config" {
+		// The config dump is the only thing config show writes to stdout
+		diag = os.Stderr
 	}
 
+	// Read a long request from stdin or a file
+	request, err := contextify.ReadRequest(requestFlag, requestFileFlag, os.Stdin)
+	if err != nil {
+		fmt.Fprintln(diag, err)
+		os.Exit(1)
+	}
+	requestFlag = request
+
 	// Handle config generation
 	if generateConfigFlag != "" {
 		directory := directoryFlag
@@ -46,7 +108,7 @@ func main() {
 		// Resolve the absolute path of the directory
 		absDir, err := filepath.Abs(directory)
 		if err != nil {
-			fmt.Printf("Error getting absolute path for directory: %v\n", err)
+			fmt.Fprintf(diag, "Error getting absolute path for directory: %v\n", err)
 			os.Exit(1)
 		}
 
@@ -57,7 +119,7 @@ func main() {
 		if directory == "." {
 			currentDir, err := os.Getwd()
 			if err != nil {
-				fmt.Printf("Error getting current working directory: %v\n", err)
+				fmt.Fprintf(diag, "Error getting current working directory: %v\n", err)
 				os.Exit(1)
 			}
 			basename = filepath.Base(currentDir)
@@ -73,11 +135,12 @@ func main() {
 
 		// Build the config map
 		configToWrite := map[string]interface{}{
-			"directory":   directory,
-			"token_limit": contextify.DefaultTokenLimit,
-			"output":      defaultOutput,
-			"omit":        []string{".git" + string(filepath.Separator)},
-			"preprompt":   contextify.DefaultPreprompt,
+			"directory":             directory,
+			"token_limit":           contextify.DefaultTokenLimit,
+			"output":                defaultOutput,
+			"omit":                  []string{".git" + string(filepath.Separator)},
+			"preprompt":             contextify.DefaultPreprompt,
+			"no_sensitive_defaults": false,
 		}
 		if requestFlag != "" {
 			configToWrite["request"] = requestFlag
@@ -86,101 +149,495 @@ func main() {
 		// Marshal and write the config file
 		configData, err := yaml.Marshal(configToWrite)
 		if err != nil {
-			fmt.Printf("Error generating config: %v\n", err)
+			fmt.Fprintf(diag, "Error generating config: %v\n", err)
 			os.Exit(1)
 		}
 		err = os.MkdirAll(filepath.Dir(generateConfigFlag), 0755)
 		if err != nil {
-			fmt.Printf("Error creating config directory: %v\n", err)
+			fmt.Fprintf(diag, "Error creating config directory: %v\n", err)
 			os.Exit(1)
 		}
 		err = ioutil.WriteFile(generateConfigFlag, configData, 0644)
 		if err != nil {
-			fmt.Printf("Error writing config file: %v\n", err)
+			fmt.Fprintf(diag, "Error writing config file: %v\n", err)
 			os.Exit(1)
 		}
 
-		fmt.Printf("Default config file generated at %s\n", generateConfigFlag)
+		fmt.Fprintf(diag, "Default config file generated at %s\n", generateConfigFlag)
 		os.Exit(0)
 	}
 
-	// Prevent mixing config file with other options
-	if configFlag != "" && (directoryFlag != "" || tokenLimitFlag != 0 || outputFlag != "" || len(skipFlags) != 0 || prepromptFlag != "" || requestFlag != "") {
-		fmt.Println("Cannot use --config with other options.")
+	// Later layers override earlier ones: defaults, the user config, project configs from the repository root
+	// down to the directory, the --config file, CONTEXTIFY_* variables, then explicit flags
+	discoveryDir := directoryFlag
+	if discoveryDir == "" {
+		discoveryDir = os.Getenv(contextify.EnvPrefix + "DIRECTORY")
+	}
+	if discoveryDir == "" {
+		discoveryDir = "."
+	}
+	configFiles, err := contextify.DiscoverConfigFiles(discoveryDir)
+	if err != nil {
+		fmt.Fprintf(diag, "Error discovering config files: %v\n", err)
 		os.Exit(1)
 	}
+	discovered := len(configFiles)
+	if configFlag != "" {
+		configFiles = append(configFiles, configFlag)
+	}
 
-	// Load configuration
-	config, err := contextify.LoadConfigFromFlags(configFlag, directoryFlag, outputFlag, prepromptFlag, requestFlag, tokenLimitFlag, skipFlags)
-	if err != nil {
-		fmt.Println(err)
+	// Show help if no arguments provided and there is no config file to run with
+	if flag.NFlag() == 0 && flag.NArg() == 0 && len(configFiles) == 0 {
+		flag.PrintDefaults()
+		os.Exit(0)
+	}
+	loader := contextify.NewConfigLoader()
+	userConfig := contextify.UserConfigFile()
+	for i, configFile := range configFiles {
+		// Paths in discovered project configs are relative to the file, elsewhere to the current directory
+		load := loader.LoadFile
+		if i < discovered && configFile != userConfig {
+			load = loader.LoadProjectFile
+		}
+		if err := load(configFile); err != nil {
+			fmt.Fprintln(diag, err)
+			os.Exit(1)
+		}
+		routeDiag(loader.Config.Output)
+	}
+
+	// A profile overrides the config files it is defined in, while the environment and flags still override it
+	profile := loader.Config.Profile
+	if env := os.Getenv(contextify.EnvPrefix + "PROFILE"); env != "" {
+		profile = env
+	}
+	if flag.CommandLine.Changed("profile") {
+		profile = profileFlag
+	}
+	if profile != "" {
+		if err := loader.ApplyProfile(profile); err != nil {
+			fmt.Fprintln(diag, err)
+			os.Exit(1)
+		}
+		routeDiag(loader.Config.Output)
+	}
+	if err := loader.LoadEnv(os.Environ()); err != nil {
+		fmt.Fprintln(diag, err)
+		os.Exit(1)
+	}
+	routeDiag(loader.Config.Output)
+	flagFields := []struct {
+		flag  string
+		key   string
+		value interface{}
+	}{
+		{"profile", "profile", profileFlag},
+		{"directory", "directory", directoryFlag},
+		{"tokens", "token_limit", tokenLimitFlag},
+		{"tokenizer", "tokenizer", tokenizerFlag},
+		{"output", "output", outputFlag},
+		{"format", "output_format", formatFlag},
+		{"skip", "omit", skipFlags},
+		{"include", "include", includeFlags},
+		{"preprompt", "preprompt", prepromptFlag},
+		{"request", "request", requestFlag},
+		{"request-file", "request", requestFlag},
+		{"skeleton", "skeleton", skeletonFlag},
+		{"strip-comments", "strip_comments", stripCommentsFlag},
+		{"secrets", "secrets", secretsFlag},
+		{"no-redact", "no_redact", noRedactFlag},
+		{"line-numbers", "line_numbers", lineNumbersFlag},
+		{"line-number-width", "line_numbers", true},
+		{"line-number-width", "line_number_width", lineNumberWidthFlag},
+		{"line-number-separator", "line_numbers", true},
+		{"line-number-separator", "line_number_separator", lineNumberSeparatorFlag},
+		{"pack", "pack", packFlag},
+		{"pack-policy", "pack_policy", packPolicyFlag},
+		{"priority", "priority", priorityFlags},
+		{"split", "split", splitFlag},
+		{"report", "report", reportFlag},
+		{"report-format", "report", true},
+		{"report-format", "report_format", reportFormatFlag},
+		{"explain", "explain", explainFlag},
+		{"verbose-selection", "explain", explainFlag},
+		{"git-tracked", "git_tracked", gitTrackedFlag},
+		{"git-untracked", "git_untracked", gitUntrackedFlag},
+		{"since", "since", sinceFlag},
+		{"staged", "staged", stagedFlag},
+		{"worktree", "worktree", worktreeFlag},
+		{"include-diff", "include_diff", includeDiffFlag},
+		{"no-gitignore", "no_gitignore", noGitignoreFlag},
+		{"no-nested-gitignore", "no_nested_gitignore", noNestedGitignoreFlag},
+		{"no-git-exclude", "no_git_exclude", noGitExcludeFlag},
+		{"no-global-excludes", "no_global_excludes", noGlobalExcludesFlag},
+		{"no-sensitive-defaults", "no_sensitive_defaults", noSensitiveDefaultsFlag},
+	}
+	for _, f := range flagFields {
+		if flag.CommandLine.Changed(f.flag) {
+			if err := loader.Set(f.key, f.value, "flag --"+f.flag); err != nil {
+				fmt.Fprintln(diag, err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	if flag.Arg(0) == "config" {
+		os.Exit(runConfig(loader, flag.Args()[1:]))
+	}
+
+	// Nothing is written when checking paths or dry-running
+	config := loader.Resolve()
+	routeDiag(config.Output)
+	if config.Output == "" && !checkIgnore && !dryRunFlag {
+		fmt.Fprintln(diag, errNoOutput)
+		os.Exit(1)
+	}
+	if err := contextify.ValidateConfig(config); err != nil {
+		fmt.Fprintln(diag, err)
 		os.Exit(1)
 	}
 
-	// Add additional ignore patterns
+	// Ignore contextify's own files
 	ignorePatterns := []string{}
 	scriptPath, err := os.Executable()
 	if err == nil {
-		relScriptPath, err := filepath.Rel(config.Directory, scriptPath)
+		relScriptPath, err := relPathFrom(config.Directory, scriptPath)
 		if err == nil && !strings.HasPrefix(relScriptPath, "..") && !filepath.IsAbs(relScriptPath) {
-			ignorePatterns = append(ignorePatterns, relScriptPath)
+			ignorePatterns = append(ignorePatterns, "/"+filepath.ToSlash(relScriptPath))
 		}
 	}
-	if configFlag != "" {
-		relConfigPath, err := filepath.Rel(config.Directory, configFlag)
+	for _, configFile := range loader.Files {
+		relConfigPath, err := relPathFrom(config.Directory, configFile)
 		if err == nil && !strings.HasPrefix(relConfigPath, "..") && !filepath.IsAbs(relConfigPath) {
-			ignorePatterns = append(ignorePatterns, relConfigPath)
+			ignorePatterns = append(ignorePatterns, "/"+filepath.ToSlash(relConfigPath))
 		}
 	}
-	relOutputPath, err := filepath.Rel(config.Directory, config.Output)
-	if err == nil && !strings.HasPrefix(relOutputPath, "..") && !filepath.IsAbs(relOutputPath) {
-		ignorePatterns = append(ignorePatterns, relOutputPath)
+	relOutputPath, err := relPathFrom(config.Directory, config.Output)
+	if err == nil && config.Output != "" && config.Output != stdio && !strings.HasPrefix(relOutputPath, "..") && !filepath.IsAbs(relOutputPath) {
+		ignorePatterns = append(ignorePatterns, "/"+filepath.ToSlash(relOutputPath))
+		ignorePatterns = append(ignorePatterns, "/"+filepath.ToSlash(contextify.PartPathPattern(relOutputPath, "*")))
+		ignorePatterns = append(ignorePatterns, "/"+filepath.ToSlash(filepath.Join(filepath.Dir(relOutputPath), tempOutputPattern(config.Output))))
 	}
-	config.Omit = append(config.Omit, ignorePatterns...)
+	config.AutoOmit = ignorePatterns
 
-	// Ensure output directory exists
-	err = os.MkdirAll(filepath.Dir(config.Output), 0755)
-	if err != nil {
-		fmt.Printf("Error creating output directory: %v\n", err)
-		os.Exit(1)
+	if checkIgnore {
+		os.Exit(runCheckIgnore(config, flag.Args()[1:]))
 	}
 
-	// Process directory and write output
-	outfile, err := os.Create(config.Output)
-	if err != nil {
-		fmt.Printf("Error creating output file: %v\n", err)
-		os.Exit(1)
+	if dryRunFlag {
+		os.Exit(runDryRun(config))
 	}
-	defer outfile.Close()
 
-	totalChars, err := contextify.ProcessDirectory(config, outfile)
+	if config.Output == stdio {
+		if config.Split {
+			fmt.Fprintln(diag, "Cannot split output written to stdout.")
+			os.Exit(1)
+		}
+	} else {
+		// Ensure output directory exists
+		err = os.MkdirAll(filepath.Dir(config.Output), 0755)
+		if err != nil {
+			fmt.Fprintf(diag, "Error creating output directory: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Process directory and write output
+	var stats *contextify.Stats
+	var partPaths []string
+	if config.Split {
+		stats, partPaths, err = writeParts(config)
+	} else {
+		stats, err = writeOutput(config)
+	}
 	if err != nil {
-		fmt.Printf("Error processing directory: %v\n", err)
+		fmt.Fprintf(diag, "Error processing directory: %v\n", err)
 		os.Exit(1)
 	}
 
 	// Verify size against context limit
-	totalTokens := totalChars / contextify.CharPerToken
-	differenceTokens := config.TokenLimit - totalTokens
+	differenceTokens := config.TokenLimit - stats.TotalTokens
 
-	fmt.Printf("\nOutput written to %s\n", config.Output)
-	fmt.Printf("Estimated size: %d characters (~%d tokens)\n", totalChars, totalTokens)
-	fmt.Printf("Context limit: %d characters (~%d tokens)\n", config.TokenLimit*contextify.CharPerToken, config.TokenLimit)
-	fmt.Printf("Difference: %d tokens (%s)\n", differenceTokens, map[bool]string{true: "Fits within limit", false: "Exceeds limit"}[differenceTokens >= 0])
+	if config.Report {
+		fmt.Fprintln(diag)
+		if err := contextify.WriteReport(diag, stats, config.ReportFormat); err != nil {
+			fmt.Fprintf(diag, "Error writing report: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
-	if differenceTokens < 0 {
-		fmt.Printf("Warning: The combined file exceeds the context limit of %d tokens. You may need to split it or reduce the number of files.\n", config.TokenLimit)
+	if config.Skeleton || config.StripComments {
+		fmt.Fprintf(diag, "\nContent transforms saved ~%d tokens\n", stats.SavedTokens())
+	}
+
+	if len(partPaths) > 1 {
+		fmt.Fprintf(diag, "\nOutput split into %d parts:\n", len(partPaths))
+		for _, partPath := range partPaths {
+			fmt.Fprintf(diag, "  %s\n", partPath)
+		}
+		fmt.Fprintf(diag, "Estimated size: %d characters (~%d tokens, %s) across all parts\n", stats.TotalChars, stats.TotalTokens, stats.Tokenizer)
+		fmt.Fprintf(diag, "Context limit: %d characters (~%d tokens) per part\n", config.TokenLimit*contextify.CharPerToken, config.TokenLimit)
+		fmt.Fprintln(diag, "Parts are not copied to the clipboard.")
+		return
+	}
+
+	if config.Output == stdio {
+		fmt.Fprintf(diag, "\nOutput written to stdout\n")
 	} else {
+		fmt.Fprintf(diag, "\nOutput written to %s\n", config.Output)
+	}
+	fmt.Fprintf(diag, "Estimated size: %d characters (~%d tokens, %s)\n", stats.TotalChars, stats.TotalTokens, stats.Tokenizer)
+	fmt.Fprintf(diag, "Context limit: %d characters (~%d tokens)\n", config.TokenLimit*contextify.CharPerToken, config.TokenLimit)
+	omitted := 0
+	for _, file := range stats.Files {
+		if file.Skipped == contextify.SkipTokenLimit {
+			omitted++
+		}
+	}
+	if omitted > 0 {
+		fmt.Fprintf(diag, "Packed to fit the limit: %d files omitted (listed at the end of the output)\n", omitted)
+	}
+	fmt.Fprintf(diag, "Difference: %d tokens (%s)\n", differenceTokens, map[bool]string{true: "Fits within limit", false: "Exceeds limit"}[differenceTokens >= 0])
+
+	if differenceTokens < 0 {
+		fmt.Fprintf(diag, "Warning: The combined file exceeds the context limit of %d tokens. You may need to split it or reduce the number of files.\n", config.TokenLimit)
+	} else if config.Output != stdio {
 		content, err := ioutil.ReadFile(config.Output)
 		if err != nil {
-			fmt.Printf("Failed to read output file for clipboard: %v\n", err)
+			fmt.Fprintf(diag, "Failed to read output file for clipboard: %v\n", err)
 		} else {
 			err = contextify.CopyToClipboard(string(content))
 			if err != nil {
-				fmt.Printf("Clipboard not supported: %v. Output is still available in %s.\n", err, config.Output)
+				fmt.Fprintf(diag, "Clipboard not supported: %v. Output is still available in %s.\n", err, config.Output)
 			} else {
-				fmt.Println("Output copied to clipboard.")
+				fmt.Fprintln(diag, "Output copied to clipboard.")
 			}
 		}
 	}
 }
+
+// relPathFrom returns target relative to base, resolving both first so relative and absolute paths can be mixed
+func relPathFrom(base, target string) (string, error) {
+	absBase, err := filepath.Abs(base)
+	if err != nil {
+		return "", err
+	}
+	absTarget, err := filepath.Abs(target)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Rel(absBase, absTarget)
+}
+
+// writeOutput processes the directory into the single output file, or stdout
+func writeOutput(config contextify.Config) (*contextify.Stats, error) {
+	if config.Output == stdio {
+		return contextify.ProcessDirectory(config, os.Stdout)
+	}
+	// Write next to the output and rename on success, so a failed or aborted run leaves the previous output alone
+	outfile, err := ioutil.TempFile(filepath.Dir(config.Output), tempOutputPattern(config.Output))
+	if err != nil {
+		return nil, fmt.Errorf("error creating output file: %v", err)
+	}
+	defer os.Remove(outfile.Name())
+	stats, err := contextify.ProcessDirectory(config, outfile)
+	if closeErr := outfile.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("error writing output file: %v", closeErr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(outfile.Name(), 0644); err != nil {
+		return nil, fmt.Errorf("error writing output file: %v", err)
+	}
+	if err := os.Rename(outfile.Name(), config.Output); err != nil {
+		return nil, fmt.Errorf("error writing output file: %v", err)
+	}
+	if err := removeStaleOutputs(config.Output, []string{config.Output}); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// tempOutputPattern returns the name pattern of the temporary file written while producing output
+func tempOutputPattern(output string) string {
+	return "." + filepath.Base(output) + ".*.tmp"
+}
+
+// writeParts processes the directory and writes one file per part, or the single output file when everything fits
+func writeParts(config contextify.Config) (*contextify.Stats, []string, error) {
+	parts, stats, err := contextify.ProcessDirectoryParts(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	partPaths := []string{config.Output}
+	if len(parts) > 1 {
+		partPaths = nil
+		for i := range parts {
+			partPaths = append(partPaths, contextify.PartPath(config.Output, i+1))
+		}
+	}
+
+	// Write every part before renaming any into place, so a failed run leaves the previous output alone
+	var tempPaths []string
+	defer func() {
+		for _, tempPath := range tempPaths {
+			os.Remove(tempPath)
+		}
+	}()
+	for _, part := range parts {
+		outfile, err := ioutil.TempFile(filepath.Dir(config.Output), tempOutputPattern(config.Output))
+		if err != nil {
+			return nil, nil, fmt.Errorf("error creating part file: %v", err)
+		}
+		tempPaths = append(tempPaths, outfile.Name())
+		_, err = outfile.Write(part)
+		if closeErr := outfile.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Chmod(outfile.Name(), 0644)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("error writing part file: %v", err)
+		}
+	}
+	for i, partPath := range partPaths {
+		if err := os.Rename(tempPaths[i], partPath); err != nil {
+			return nil, nil, fmt.Errorf("error writing part file: %v", err)
+		}
+	}
+	if err := removeStaleOutputs(config.Output, partPaths); err != nil {
+		return nil, nil, err
+	}
+	return stats, partPaths, nil
+}
+
+// removeStaleOutputs removes the single output file and numbered part files of earlier runs that are not
+// among the paths just written, so old and new output are never mixed
+func removeStaleOutputs(output string, written []string) error {
+	matches, err := filepath.Glob(contextify.PartPathPattern(output, "[0-9]*"))
+	if err != nil {
+		return fmt.Errorf("error listing part files: %v", err)
+	}
+	for _, path := range append(matches, output) {
+		if containsPath(written, path) {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing stale output: %v", err)
+		}
+	}
+	return nil
+}
+
+// containsPath reports whether paths contains path
+func containsPath(paths []string, path string) bool {
+	for _, p := range paths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+// routeDiag points diag at stderr once a layer sends the output to stdout
+func routeDiag(output string) {
+	if output == stdio {
+		diag = os.Stderr
+	}
+}
+
+// runConfig handles the config subcommands and returns the exit code. Only the config dump goes to stdout,
+// so it can be piped; errors and other messages go to stderr.
+func runConfig(loader *contextify.ConfigLoader, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: contextify config show|validate [options]")
+		return 1
+	}
+	switch args[0] {
+	case "show":
+		if err := loader.WriteConfig(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	case "validate":
+		config := loader.Resolve()
+		err := contextify.ValidateConfig(config)
+		if err == nil && config.Output == "" {
+			err = errNoOutput
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		files := "none"
+		if len(loader.Files) > 0 {
+			files = strings.Join(loader.Files, ", ")
+		}
+		fmt.Fprintf(os.Stderr, "Configuration is valid (config files: %s)\n", files)
+	default:
+		fmt.Fprintln(os.Stderr, "Usage: contextify config show|validate [options]")
+		return 1
+	}
+	return 0
+}
+
+// runDryRun selects and measures files exactly as a real run would, printing the selection instead of writing output
+func runDryRun(config contextify.Config) int {
+	stats, err := contextify.ProcessDirectory(config, ioutil.Discard)
+	if err != nil {
+		fmt.Fprintf(diag, "Error processing directory: %v\n", err)
+		return 1
+	}
+	fmt.Fprintln(diag)
+	if err := contextify.WriteSelection(os.Stdout, stats, config.TokenLimit); err != nil {
+		fmt.Fprintf(diag, "Error writing selection: %v\n", err)
+		return 1
+	}
+	if config.Report {
+		fmt.Fprintln(diag)
+		if err := contextify.WriteReport(os.Stdout, stats, config.ReportFormat); err != nil {
+			fmt.Fprintf(diag, "Error writing report: %v\n", err)
+			return 1
+		}
+	}
+	fmt.Fprintln(diag, "Dry run: nothing was written.")
+	return 0
+}
+
+// runCheckIgnore prints the selection decision for each path, given relative to the working directory, and returns the exit code
+func runCheckIgnore(config contextify.Config, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(diag, "Usage: contextify check-ignore [options] <path>...")
+		return 1
+	}
+	absDir, err := filepath.Abs(config.Directory)
+	if err != nil {
+		fmt.Fprintf(diag, "Error getting absolute path for directory: %v\n", err)
+		return 1
+	}
+	var paths []string
+	for _, arg := range args {
+		absPath, err := filepath.Abs(arg)
+		if err != nil {
+			fmt.Fprintf(diag, "Error getting absolute path for %s: %v\n", arg, err)
+			return 1
+		}
+		relPath, err := filepath.Rel(absDir, absPath)
+		if err != nil || relPath == "." || strings.HasPrefix(relPath, "..") {
+			fmt.Fprintf(diag, "%s is not inside %s\n", arg, config.Directory)
+			return 1
+		}
+		paths = append(paths, relPath)
+	}
+	decisions, err := contextify.CheckIgnore(config, paths)
+	if err != nil {
+		fmt.Fprintln(diag, err)
+		return 1
+	}
+	for _, d := range decisions {
+		fmt.Fprintln(diag, d)
+	}
+	return 0
+}
@@ -0,0 +1,670 @@
+package contextify
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix starts the name of every environment variable that sets a config field, e.g. CONTEXTIFY_TOKEN_LIMIT
+const EnvPrefix = "CONTEXTIFY_"
+
+// SourceDefault is the source of fields left at their built-in defaults
+const SourceDefault = "default"
+
+// ProjectConfigFiles are the names of config files discovered in a project, in order of preference within a directory
+var ProjectConfigFiles = []string{".contextify.yaml", ".contextify.yml"}
+
+// DefaultConfig returns the built-in defaults that config files, environment variables and flags override
+func DefaultConfig() Config {
+	return Config{
+		Directory:  ".",
+		TokenLimit: DefaultTokenLimit,
+		Preprompt:  DefaultPreprompt,
+	}
+}
+
+// applyDefaults fills the fields that an empty or zero value leaves to the defaults, whichever source set them
+func applyDefaults(config *Config) {
+	defaults := DefaultConfig()
+	if config.Directory == "" {
+		config.Directory = defaults.Directory
+	}
+	if config.TokenLimit == 0 {
+		config.TokenLimit = defaults.TokenLimit
+	}
+	if config.Preprompt == "" {
+		config.Preprompt = defaults.Preprompt
+	}
+}
+
+// substituteRequest fills the <request> slot of the preprompt, or appends the request when there is no slot,
+// keeping the original in PrepromptTemplate
+func substituteRequest(config *Config) {
+	config.PrepromptTemplate = config.Preprompt
+	if config.Request == "" {
+		return
+	}
+	if strings.Contains(config.Preprompt, "<request>") {
+		config.Preprompt = strings.Replace(config.Preprompt, "<request>", config.Request, 1)
+	} else {
+		config.Preprompt += "\n\nRequest:\n\n" + config.Request
+	}
+}
+
+// ReadRequest returns the request given on the command line, reading it from stdin when it is "-" or from
+// requestFile when that is set, with trailing newlines trimmed
+func ReadRequest(request, requestFile string, stdin io.Reader) (string, error) {
+	if request != "" && requestFile != "" {
+		return "", fmt.Errorf("cannot use --request with --request-file")
+	}
+	var data []byte
+	var err error
+	switch {
+	case request == "-":
+		data, err = ioutil.ReadAll(stdin)
+	case requestFile != "":
+		data, err = ioutil.ReadFile(requestFile)
+	default:
+		return request, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error reading request: %v", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// ValidateConfig checks a merged config for values that are out of range or not recognized, reporting every
+// problem at once
+func ValidateConfig(config Config) error {
+	var problems []string
+	check := func(err error) {
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if config.TokenLimit < 0 {
+		check(fmt.Errorf("token_limit must be positive (or 0 for the default), got %d", config.TokenLimit))
+	}
+	if config.LineNumberWidth < 0 || config.LineNumberWidth > maxLineNumberWidth {
+		check(fmt.Errorf("line_number_width must be between 0 and %d, got %d", maxLineNumberWidth, config.LineNumberWidth))
+	}
+	if info, err := os.Stat(config.Directory); err != nil {
+		check(fmt.Errorf("directory %s does not exist", config.Directory))
+	} else if !info.IsDir() {
+		check(fmt.Errorf("directory %s is not a directory", config.Directory))
+	}
+	_, err := NewTokenizer(config.Tokenizer)
+	check(err)
+	_, err = lookupFormatter(config.OutputFormat)
+	check(err)
+	_, err = secretsAction(config)
+	check(err)
+	switch config.PackPolicy {
+	case "", PackPriority, PackSmallest, PackRecent, PackRequest:
+	default:
+		check(fmt.Errorf("unknown pack policy %q (expected %s, %s, %s or %s)", config.PackPolicy, PackPriority, PackSmallest, PackRecent, PackRequest))
+	}
+	switch config.ReportFormat {
+	case "", ReportText, ReportJSON:
+	default:
+		check(fmt.Errorf("unknown report format %q (expected %s or %s)", config.ReportFormat, ReportText, ReportJSON))
+	}
+	_, err = diffArgs(config)
+	check(err)
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// maxLineNumberWidth bounds Config.LineNumberWidth
+const maxLineNumberWidth = 20
+
+// ConfigLoader merges configuration layers in the order they are applied, so later layers take precedence,
+// and records which source set each field
+type ConfigLoader struct {
+	Config  Config
+	Sources map[string]string // Source of each field keyed by its YAML name, such as a file path or "flag --tokens"
+	Files   []string          // Config files loaded, in order
+	omitDir string            // Directory anchored omit patterns are relative to, "" for the processed directory
+}
+
+// NewConfigLoader starts from DefaultConfig
+func NewConfigLoader() *ConfigLoader {
+	l := &ConfigLoader{Config: DefaultConfig(), Sources: map[string]string{}}
+	for _, key := range ConfigKeys() {
+		l.Sources[key] = SourceDefault
+	}
+	return l
+}
+
+// ConfigKeys returns the YAML names of the Config fields in declaration order
+func ConfigKeys() []string {
+	var keys []string
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		if key := yamlKey(t.Field(i)); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// yamlKey returns the YAML name of a struct field, or "" when it is not read from YAML
+func yamlKey(field reflect.StructField) string {
+	key := strings.Split(field.Tag.Get("yaml"), ",")[0]
+	if key == "-" {
+		return ""
+	}
+	return key
+}
+
+// field returns the settable Config field with the given YAML name
+func (l *ConfigLoader) field(key string) (reflect.Value, bool) {
+	v := reflect.ValueOf(&l.Config).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if yamlKey(v.Type().Field(i)) == key {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// LoadFile applies the fields present in a YAML config file; fields it leaves out keep their current values.
+// Unknown fields are errors, reported with their line and column. Relative paths are relative to the current directory.
+func (l *ConfigLoader) LoadFile(path string) error {
+	return l.loadFile(path, "")
+}
+
+// LoadProjectFile loads a project config found by DiscoverConfigFiles like LoadFile, except that its relative
+// directory and output, including those of its profiles, are relative to the file's own directory, and its
+// anchored omit patterns are rebased onto the processed directory
+func (l *ConfigLoader) LoadProjectFile(path string) error {
+	return l.loadFile(path, filepath.Dir(path))
+}
+
+// loadFile applies a config file, resolving its relative paths against base unless base is empty
+func (l *ConfigLoader) loadFile(path, base string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %v", err)
+	}
+	l.Files = append(l.Files, path)
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("error parsing config file %s: %v", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+	root := doc.Content[0]
+	if problems := checkFields(path, root); len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "\n"))
+	}
+	if err := root.Decode(&l.Config); err != nil {
+		if typeErr, ok := err.(*yaml.TypeError); ok {
+			return fmt.Errorf("%s: %s", path, strings.Join(typeErr.Errors, "\n"+path+": "))
+		}
+		return fmt.Errorf("error parsing config file %s: %v", path, err)
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if _, ok := l.Sources[root.Content[i].Value]; ok {
+			l.Sources[root.Content[i].Value] = path
+		}
+	}
+	l.resolvePaths(root, base)
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value != "profiles" {
+			continue
+		}
+		for j := 0; j+1 < len(root.Content[i+1].Content); j += 2 {
+			name := root.Content[i+1].Content[j].Value
+			profile := l.Config.Profiles[name]
+			profile.base = base
+			l.Config.Profiles[name] = profile
+		}
+	}
+	return nil
+}
+
+// resolvePaths makes the relative directory and output set by a mapping of config fields relative to base, and
+// records base as the directory of the anchored omit patterns it sets. An empty base leaves the values as they are.
+func (l *ConfigLoader) resolvePaths(node *yaml.Node, base string) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		switch node.Content[i].Value {
+		case "directory":
+			l.Config.Directory = joinRelative(base, l.Config.Directory)
+		case "output":
+			if l.Config.Output != "-" {
+				l.Config.Output = joinRelative(base, l.Config.Output)
+			}
+		case "omit":
+			l.omitDir = base
+		}
+	}
+}
+
+// joinRelative joins a relative path to base, returning absolute and empty paths unchanged
+func joinRelative(base, p string) string {
+	if base == "" || p == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(base, p)
+}
+
+// rebaseOmit rewrites omit patterns anchored at base so they are anchored at directory instead. Anchored
+// patterns that cannot match anything inside directory, or that name directory itself, are dropped.
+func rebaseOmit(patterns []string, base, directory string) []string {
+	absBase, err := filepath.Abs(base)
+	if err != nil {
+		return patterns
+	}
+	absDir, err := filepath.Abs(directory)
+	if err != nil {
+		return patterns
+	}
+	down, err := filepath.Rel(absBase, absDir)
+	if err != nil || down == "." {
+		return patterns
+	}
+	up, _ := filepath.Rel(absDir, absBase)
+	var rebased []string
+	for _, pattern := range patterns {
+		rule, ok := ParseIgnoreRule(pattern, "omit")
+		if !ok || !rule.Anchored {
+			rebased = append(rebased, pattern)
+			continue
+		}
+		prefix := ""
+		if rule.Negate {
+			prefix = "!"
+		}
+		body := strings.TrimPrefix(strings.TrimPrefix(rule.Pattern, "!"), "/")
+		switch {
+		case !strings.HasPrefix(down, ".."):
+			// The processed directory is inside base, so its path must lead the pattern
+			suffix := ""
+			if rule.DirOnly {
+				suffix = "/"
+			}
+			segments := strings.Split(strings.TrimRight(body, "/"), "/")
+			for _, dir := range strings.Split(filepath.ToSlash(down), "/") {
+				if segments[0] == "**" {
+					break
+				}
+				if matched, _ := path.Match(segments[0], dir); !matched || len(segments) == 1 {
+					segments = nil
+					break
+				}
+				segments = segments[1:]
+			}
+			if segments != nil {
+				rebased = append(rebased, prefix+"/"+strings.Join(segments, "/")+suffix)
+			}
+		case up != "" && !strings.HasPrefix(up, ".."):
+			// base is inside the processed directory
+			rebased = append(rebased, prefix+"/"+filepath.ToSlash(up)+"/"+body)
+		}
+	}
+	return rebased
+}
+
+// checkFields reports fields of a config file, and of its profiles, that do not exist, as path:line:column messages
+func checkFields(path string, root *yaml.Node) []string {
+	if root.Kind != yaml.MappingNode {
+		return []string{fmt.Sprintf("%s:%d:%d: expected a mapping of config fields", path, root.Line, root.Column)}
+	}
+	var problems []string
+	unknown := func(key *yaml.Node, known []string, where, note string) {
+		problem := fmt.Sprintf("%s:%d:%d: unknown field %q%s", path, key.Line, key.Column, key.Value, where)
+		if suggestion := closestKey(key.Value, known); suggestion != "" {
+			problem += fmt.Sprintf(" (did you mean %q?)", suggestion)
+		}
+		problems = append(problems, problem+note)
+	}
+	keys := ConfigKeys()
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		if !containsString(keys, key.Value) {
+			unknown(key, keys, "", "")
+			continue
+		}
+		if key.Value != "profiles" || value.Kind != yaml.MappingNode {
+			continue
+		}
+		profileKeys := append([]string{"extends"}, ProfileKeys...)
+		for j := 0; j+1 < len(value.Content); j += 2 {
+			name, profile := value.Content[j], value.Content[j+1]
+			if profile.Kind != yaml.MappingNode {
+				problems = append(problems, fmt.Sprintf("%s:%d:%d: profile %q must be a mapping", path, profile.Line, profile.Column, name.Value))
+				continue
+			}
+			for k := 0; k+1 < len(profile.Content); k += 2 {
+				if field := profile.Content[k]; !containsString(profileKeys, field.Value) {
+					unknown(field, profileKeys, fmt.Sprintf(" in profile %q", name.Value), "; profiles can set "+strings.Join(profileKeys, ", "))
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// closestKey returns the key within an edit distance of 2 of s, for suggesting a correction, or ""
+func closestKey(s string, keys []string) string {
+	best, bestDistance := "", 3
+	for _, key := range keys {
+		if d := editDistance(s, key); d < bestDistance {
+			best, bestDistance = key, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, minInt(cur[j-1]+1, prev[j-1]+cost))
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// UserConfigFile returns the user-level config file in $XDG_CONFIG_HOME/contextify (config.yaml, or config.yml
+// if only that exists), or "" when there is no config directory
+func UserConfigFile() string {
+	xdgConfig := xdgConfigHome()
+	if xdgConfig == "" {
+		return ""
+	}
+	dir := filepath.Join(xdgConfig, "contextify")
+	if path := findConfigFile(dir, []string{"config.yaml", "config.yml"}); path != "" {
+		return path
+	}
+	return filepath.Join(dir, "config.yaml")
+}
+
+// DiscoverConfigFiles returns the existing config files that apply to directory, lowest precedence first: the
+// user config, then the project config (see ProjectConfigFiles) of each directory from the repository root down
+// to directory. Outside a git repository only directory itself is searched.
+func DiscoverConfigFiles(directory string) ([]string, error) {
+	var files []string
+	if path := UserConfigFile(); path != "" {
+		if _, err := os.Stat(path); err == nil {
+			files = append(files, path)
+		}
+	}
+
+	absDir, err := filepath.Abs(directory)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving directory: %v", err)
+	}
+	repo, err := FindGitRepo(absDir)
+	if err != nil {
+		return nil, err
+	}
+	dirs := []string{absDir}
+	if repo != nil {
+		for dir := absDir; dir != repo.Root && dir != filepath.Dir(dir); {
+			dir = filepath.Dir(dir)
+			dirs = append(dirs, dir)
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if path := findConfigFile(dirs[i], ProjectConfigFiles); path != "" {
+			files = append(files, path)
+		}
+	}
+	return files, nil
+}
+
+// findConfigFile returns the first of names that exists as a file in dir, or ""
+func findConfigFile(dir string, names []string) string {
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path
+		}
+	}
+	return ""
+}
+
+// xdgConfigHome returns $XDG_CONFIG_HOME, defaulting to ~/.config, or "" when neither is known
+func xdgConfigHome() string {
+	if xdgConfig := os.Getenv("XDG_CONFIG_HOME"); xdgConfig != "" {
+		return xdgConfig
+	}
+	if home, err := os.UserHomeDir(); err == nil && home != "" {
+		return filepath.Join(home, ".config")
+	}
+	return ""
+}
+
+// LoadEnv applies CONTEXTIFY_* variables from environ, given as KEY=value pairs like os.Environ. The variable
+// name is the upper-cased YAML name; lists are comma-separated.
+func (l *ConfigLoader) LoadEnv(environ []string) error {
+	for _, entry := range environ {
+		name := strings.SplitN(entry, "=", 2)
+		if len(name) != 2 || !strings.HasPrefix(name[0], EnvPrefix) {
+			continue
+		}
+		key := strings.ToLower(strings.TrimPrefix(name[0], EnvPrefix))
+		field, ok := l.field(key)
+		if !ok {
+			continue
+		}
+		if err := setFromString(field, name[1]); err != nil {
+			return fmt.Errorf("invalid %s: %v", name[0], err)
+		}
+		l.Sources[key] = "env " + name[0]
+		if key == "omit" {
+			l.omitDir = ""
+		}
+	}
+	return nil
+}
+
+// setFromString parses value into a string, int, bool or string list field
+func setFromString(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("expected an integer, got %q", value)
+		}
+		field.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("expected true or false, got %q", value)
+		}
+		field.SetBool(b)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Type())
+	}
+	return nil
+}
+
+// Set overrides a field, given by its YAML name, with a value of the field's type, such as an explicit flag
+func (l *ConfigLoader) Set(key string, value interface{}, source string) error {
+	field, ok := l.field(key)
+	if !ok {
+		return fmt.Errorf("unknown config field %q", key)
+	}
+	v := reflect.ValueOf(value)
+	if !v.Type().AssignableTo(field.Type()) {
+		return fmt.Errorf("cannot set %s (%s) to a %s", key, field.Type(), v.Type())
+	}
+	field.Set(v)
+	l.Sources[key] = source
+	if key == "omit" {
+		l.omitDir = ""
+	}
+	return nil
+}
+
+// Resolve returns the merged config with defaults for empty fields and the request substituted into the preprompt
+func (l *ConfigLoader) Resolve() Config {
+	config := l.Config
+	applyDefaults(&config)
+	substituteRequest(&config)
+	if l.omitDir != "" {
+		config.Omit = rebaseOmit(config.Omit, l.omitDir, config.Directory)
+	}
+	return config
+}
+
+// WriteConfig prints every field of the merged config as YAML, each followed by a comment naming its source
+func (l *ConfigLoader) WriteConfig(w io.Writer) error {
+	for _, key := range ConfigKeys() {
+		field, _ := l.field(key)
+		var value string
+		switch field.Kind() {
+		case reflect.String:
+			value = strconv.Quote(field.String())
+		case reflect.Slice, reflect.Map:
+			list, ok := field.Interface().([]string)
+			if !ok {
+				list = l.profileNames()
+			}
+			data, err := yaml.Marshal(yamlFlowList(list))
+			if err != nil {
+				return fmt.Errorf("error encoding %s: %v", key, err)
+			}
+			value = strings.TrimSpace(string(data))
+		default:
+			value = fmt.Sprint(field.Interface())
+		}
+		if _, err := fmt.Fprintf(w, "%s: %s  # %s\n", key, value, l.Sources[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// yamlFlowList is a string list marshaled on one line, like [a, b]
+type yamlFlowList []string
+
+func (f yamlFlowList) MarshalYAML() (interface{}, error) {
+	node := &yaml.Node{Kind: yaml.SequenceNode, Style: yaml.FlowStyle}
+	for _, item := range f {
+		node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: item})
+	}
+	return node, nil
+}
+
+// ProfileKeys are the fields a profile can override
+var ProfileKeys = []string{"directory", "token_limit", "output", "output_format", "omit", "include", "preprompt"}
+
+// Profile is a named set of overrides in the profiles map of a config file. Fields the profile leaves out
+// keep the values of the profile it extends, or of the config it is applied to.
+type Profile struct {
+	Extends string     // Name of the profile this one starts from
+	node    *yaml.Node // Mapping of the overridden fields, without extends
+	base    string     // Directory relative paths are relative to, "" for the current directory
+}
+
+func (p *Profile) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: a profile must be a mapping", value.Line)
+	}
+	p.node = &yaml.Node{Kind: yaml.MappingNode}
+	for i := 0; i+1 < len(value.Content); i += 2 {
+		key, val := value.Content[i], value.Content[i+1]
+		if key.Value == "extends" {
+			if err := val.Decode(&p.Extends); err != nil {
+				return err
+			}
+			continue
+		}
+		if !containsString(ProfileKeys, key.Value) {
+			return fmt.Errorf("line %d: %s cannot be set in a profile", key.Line, key.Value)
+		}
+		p.node.Content = append(p.node.Content, key, val)
+	}
+	return nil
+}
+
+// ApplyProfile overrides fields with those of the named profile and the profiles it extends, base first
+func (l *ConfigLoader) ApplyProfile(name string) error {
+	var chain []string
+	for current := name; current != ""; current = l.Config.Profiles[current].Extends {
+		if _, ok := l.Config.Profiles[current]; !ok {
+			return fmt.Errorf("unknown profile %q (known profiles: %s)", current, strings.Join(l.profileNames(), ", "))
+		}
+		if containsString(chain, current) {
+			return fmt.Errorf("profile %q extends itself through %s", current, strings.Join(append(chain, current), " -> "))
+		}
+		chain = append(chain, current)
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		profile := l.Config.Profiles[chain[i]]
+		if err := profile.node.Decode(&l.Config); err != nil {
+			return fmt.Errorf("error applying profile %q: %v", chain[i], err)
+		}
+		for j := 0; j < len(profile.node.Content); j += 2 {
+			l.Sources[profile.node.Content[j].Value] = "profile " + chain[i]
+		}
+		l.resolvePaths(profile.node, profile.base)
+	}
+	l.Config.Profile = name
+	return nil
+}
+
+// profileNames returns the names of the defined profiles, sorted
+func (l *ConfigLoader) profileNames() []string {
+	var names []string
+	for name := range l.Config.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// containsString reports whether list contains s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -3,6 +3,8 @@ package contextify
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -11,8 +13,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
-
-	"gopkg.in/yaml.v3"
+	"time"
 
 	"golang.org/x/text/encoding/unicode"
 	"golang.org/x/text/transform"
@@ -79,14 +80,11 @@ func CopyToClipboard(content string) error {
 func LoadConfigFromFlags(configFlag, directoryFlag, outputFlag, prepromptFlag, requestFlag string, tokenLimitFlag int, skipFlags []string) (Config, error) {
 	var config Config
 	if configFlag != "" {
-		configData, err := ioutil.ReadFile(configFlag)
-		if err != nil {
-			return config, fmt.Errorf("error reading config file: %v", err)
-		}
-		err = yaml.Unmarshal(configData, &config)
-		if err != nil {
-			return config, fmt.Errorf("error parsing config file: %v", err)
+		loader := NewConfigLoader()
+		if err := loader.LoadFile(configFlag); err != nil {
+			return config, err
 		}
+		config = loader.Config
 		if config.Output == "" {
 			return config, fmt.Errorf("output path is required in the config file")
 		}
@@ -102,45 +100,96 @@ func LoadConfigFromFlags(configFlag, directoryFlag, outputFlag, prepromptFlag, r
 			Preprompt:  prepromptFlag,
 			Request:    requestFlag,
 		}
-		if config.Directory == "" {
-			config.Directory = "."
-		}
-		if config.TokenLimit == 0 {
-			config.TokenLimit = DefaultTokenLimit
-		}
-		if config.Preprompt == "" {
-			config.Preprompt = DefaultPreprompt
-		}
-	}
-	if config.Request != "" {
-		if strings.Contains(config.Preprompt, "<request>") {
-			config.Preprompt = strings.Replace(config.Preprompt, "<request>", config.Request, 1)
-		} else {
-			config.Preprompt += "\n\nRequest:\n\n" + config.Request
-		}
 	}
+	applyDefaults(&config)
+	substituteRequest(&config)
 	return config, nil
 }
 
 // Config holds the configuration settings
 type Config struct {
-	Directory  string   `yaml:"directory"`
-	TokenLimit int      `yaml:"token_limit"`
-	Output     string   `yaml:"output"`
-	Omit       []string `yaml:"omit"`
-	Preprompt  string   `yaml:"preprompt"`
-	Request    string   `yaml:"request"`
+	Directory    string   `yaml:"directory"`
+	TokenLimit   int      `yaml:"token_limit"`
+	Tokenizer    string   `yaml:"tokenizer"`
+	Output       string   `yaml:"output"`
+	OutputFormat string   `yaml:"output_format"` // text (default), markdown, xml, json or jsonl
+	Omit         []string `yaml:"omit"`
+	Include      []string `yaml:"include"`
+	Preprompt    string   `yaml:"preprompt"`
+	Request      string   `yaml:"request"`
+
+	// Preprompt before the request was substituted into it, set along with Preprompt when loading
+	PrepromptTemplate string `yaml:"-"`
+
+	// Reduce Go files to package clause, imports, declarations and signatures
+	Skeleton bool `yaml:"skeleton"`
+
+	// Remove comments and collapse blank lines in languages with known comment syntax
+	StripComments bool `yaml:"strip_comments"`
+
+	// Scanning for credentials before anything is written
+	Secrets  string `yaml:"secrets"`   // What to do with files containing possible secrets: redact (default), skip or abort
+	NoRedact bool   `yaml:"no_redact"` // Turn scanning off and write secrets as they are
+
+	// Line numbers prefixed to every line of file contents
+	LineNumbers         bool   `yaml:"line_numbers"`
+	LineNumberWidth     int    `yaml:"line_number_width"`     // Minimum width numbers are right-aligned to; each file is widened to fit its last line
+	LineNumberSeparator string `yaml:"line_number_separator"` // Text between the number and the line, " | " by default
+
+	// Budget-aware packing when the output would exceed TokenLimit
+	Pack       bool     `yaml:"pack"`        // Drop files that do not fit instead of only warning
+	PackPolicy string   `yaml:"pack_policy"` // Order files are packed in: priority (default), smallest, recent or request
+	Priority   []string `yaml:"priority"`    // Patterns whose files are packed first, in order, under any policy
+
+	// Split output exceeding TokenLimit into numbered part files
+	Split bool `yaml:"split"`
+
+	// Breakdown printed after a run
+	Report       bool   `yaml:"report"`
+	ReportFormat string `yaml:"report_format"` // text (default) or json
+	Explain      bool   `yaml:"explain"`       // Print why each path was selected or skipped
+
+	// File selection from the git index instead of walking the directory
+	GitTracked   bool `yaml:"git_tracked"`   // List files with git ls-files semantics
+	GitUntracked bool `yaml:"git_untracked"` // Also list untracked files that are not ignored
+
+	// Restriction to files changed in git; at most one mode may be set
+	Since       string `yaml:"since"`        // Changes since the merge base of a ref and HEAD, including uncommitted ones
+	Staged      bool   `yaml:"staged"`       // Changes staged in the index
+	Worktree    bool   `yaml:"worktree"`     // Unstaged changes in the working tree
+	IncludeDiff bool   `yaml:"include_diff"` // Append the unified diff after the file contents
+
+	// Ignore layers that can be turned off individually
+	NoGitignore       bool `yaml:"no_gitignore"`        // Skip every .gitignore file
+	NoNestedGitignore bool `yaml:"no_nested_gitignore"` // Only read the .gitignore in the processed directory
+	NoGitExclude      bool `yaml:"no_git_exclude"`      // Skip .git/info/exclude
+	NoGlobalExcludes  bool `yaml:"no_global_excludes"`  // Skip the core.excludesFile from git config
+
+	// Files that commonly hold credentials, skipped unless turned off or re-included by a negated pattern
+	NoSensitiveDefaults bool `yaml:"no_sensitive_defaults"`
+
+	// Named overrides selected with Profile, usually with --profile
+	Profile  string             `yaml:"profile"`
+	Profiles map[string]Profile `yaml:"profiles"`
+
+	// Contextify's own files (executable, config file, output) inside Directory, ignored above every other layer
+	AutoOmit []string `yaml:"-"`
 }
 
-// countingWriter wraps an io.Writer and counts bytes written
+// countingWriter wraps an io.Writer and counts bytes and tokens written
 type countingWriter struct {
-	writer io.Writer
-	count  int
+	writer    io.Writer
+	tokenizer Tokenizer
+	count     int
+	tokens    int
 }
 
 func (cw *countingWriter) Write(p []byte) (n int, err error) {
 	n, err = cw.writer.Write(p)
 	cw.count += n
+	if cw.tokenizer != nil {
+		cw.tokens += cw.tokenizer.CountTokens(string(p[:n]))
+	}
 	return n, err
 }
 
@@ -158,8 +207,8 @@ func LoadGitignore(gitignorePath string) ([]string, error) {
 
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line != "" && !strings.HasPrefix(line, "#") {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if strings.TrimSpace(line) != "" && !strings.HasPrefix(line, "#") {
 			patterns = append(patterns, line)
 		}
 	}
@@ -171,27 +220,24 @@ func LoadGitignore(gitignorePath string) ([]string, error) {
 
 // IsIgnored checks if a file or directory should be ignored
 func IsIgnored(path string, isDir bool, ignorePatterns []string) bool {
-	// Normalize the input path
-	normalizedPath := filepath.Clean(path)
-	if isDir {
-		normalizedPath += string(filepath.Separator)
-	}
-
-	for _, pattern := range ignorePatterns {
-		// Replace '/' with the platform's separator in the pattern
-		normalizedPattern := strings.ReplaceAll(pattern, "/", string(filepath.Separator))
-		if matched, _ := filepath.Match(normalizedPattern, normalizedPath); matched {
-			return true
-		}
-		if matched, _ := filepath.Match(normalizedPattern+"*", normalizedPath); matched {
-			return true
-		}
-	}
-	return false
+	ignored, _ := newPatternStack(ignorePatterns).Match(path, isDir)
+	return ignored
 }
 
 // GenerateTree generates a directory tree structure
 func GenerateTree(currentDir string, ignorePatterns []string, prefix string, rootDir string) []string {
+	return generateTree(currentDir, newPatternStack(ignorePatterns), prefix, rootDir)
+}
+
+// treeNode is a file or directory in a generated tree
+type treeNode struct {
+	name     string
+	isDir    bool
+	children []*treeNode
+}
+
+// generateTree generates a directory tree structure using a prepared ignore stack
+func generateTree(currentDir string, ignores *IgnoreStack, prefix string, rootDir string) []string {
 	if filepath.Base(currentDir) == ".git" {
 		return nil
 	}
@@ -199,38 +245,58 @@ func GenerateTree(currentDir string, ignorePatterns []string, prefix string, roo
 	if prefix == "" {
 		lines = append(lines, filepath.Base(currentDir))
 	}
+	node := readTree(currentDir, ignores, rootDir)
+	return append(lines, renderTree(node, prefix)...)
+}
+
+// readTree reads the non-ignored contents of currentDir, pruning directories without included files when an include list is active
+func readTree(currentDir string, ignores *IgnoreStack, rootDir string) *treeNode {
+	node := &treeNode{name: filepath.Base(currentDir), isDir: true}
 	files, err := ioutil.ReadDir(currentDir)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error reading directory %s: %v\n", currentDir, err)
-		return lines
+		return node
 	}
-	var contents []string
 	for _, file := range files {
 		fullPath := filepath.Join(currentDir, file.Name())
 		relPath, _ := filepath.Rel(rootDir, fullPath)
-		if file.IsDir() {
-			if !IsIgnored(relPath, true, ignorePatterns) {
-				contents = append(contents, file.Name())
+		if ignored, _ := ignores.Match(relPath, file.IsDir()); ignored {
+			continue
+		}
+		stat, err := os.Stat(fullPath)
+		if err != nil {
+			continue
+		}
+		if stat.IsDir() {
+			child := &treeNode{name: file.Name(), isDir: true}
+			if file.Name() != ".git" {
+				child = readTree(fullPath, ignores, rootDir)
 			}
-		} else {
-			if !IsIgnored(relPath, false, ignorePatterns) {
-				contents = append(contents, file.Name())
+			if ignores.HasIncludes() && len(child.children) == 0 {
+				continue
 			}
+			node.children = append(node.children, child)
+		} else if ignores.Includes(relPath) {
+			node.children = append(node.children, &treeNode{name: file.Name()})
 		}
 	}
-	dirs := []string{}
-	filesList := []string{}
-	for _, content := range contents {
-		if stat, err := os.Stat(filepath.Join(currentDir, content)); err == nil {
-			if stat.IsDir() {
-				dirs = append(dirs, content)
-			} else {
-				filesList = append(filesList, content)
-			}
+	return node
+}
+
+// renderTree renders the children of node, directories first, each group sorted by name
+func renderTree(node *treeNode, prefix string) []string {
+	var lines []string
+	dirs := []*treeNode{}
+	filesList := []*treeNode{}
+	for _, child := range node.children {
+		if child.isDir {
+			dirs = append(dirs, child)
+		} else {
+			filesList = append(filesList, child)
 		}
 	}
-	sort.Strings(dirs)
-	sort.Strings(filesList)
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].name < dirs[j].name })
+	sort.Slice(filesList, func(i, j int) bool { return filesList[i].name < filesList[j].name })
 	for i, d := range dirs {
 		isLast := (i == len(dirs)-1 && len(filesList) == 0)
 		pointer := "├── "
@@ -241,8 +307,8 @@ func GenerateTree(currentDir string, ignorePatterns []string, prefix string, roo
 		if isLast {
 			extension = "    "
 		}
-		lines = append(lines, prefix+pointer+d)
-		subLines := GenerateTree(filepath.Join(currentDir, d), ignorePatterns, prefix+extension, rootDir)
+		lines = append(lines, prefix+pointer+d.name)
+		subLines := renderTree(d, prefix+extension)
 		lines = append(lines, subLines...)
 	}
 	for i, f := range filesList {
@@ -250,7 +316,7 @@ func GenerateTree(currentDir string, ignorePatterns []string, prefix string, roo
 		if i == len(filesList)-1 {
 			pointer = "└── "
 		}
-		lines = append(lines, prefix+pointer+f)
+		lines = append(lines, prefix+pointer+f.name)
 	}
 	return lines
 }
@@ -286,81 +352,217 @@ func IsBinaryFile(filepath string) bool {
 	return false
 }
 
-// ProcessDirectory processes the directory and writes output to writer, returning total characters written
-func ProcessDirectory(config Config, writer io.Writer) (int, error) {
-	cw := &countingWriter{writer: writer}
+// diffArgs returns the git diff arguments for the config's diff mode, or nil when no mode is set
+func diffArgs(config Config) ([]string, error) {
+	var args []string
+	modes := 0
+	if config.Since != "" {
+		args = []string{"--merge-base", config.Since}
+		modes++
+	}
+	if config.Staged {
+		args = []string{"--cached"}
+		modes++
+	}
+	if config.Worktree {
+		args = []string{}
+		modes++
+	}
+	if modes > 1 {
+		return nil, fmt.Errorf("only one of since, staged and worktree can be used")
+	}
+	if config.IncludeDiff && modes == 0 {
+		return nil, fmt.Errorf("include_diff requires one of since, staged or worktree")
+	}
+	return args, nil
+}
 
-	// Load ignore patterns
-	gitignorePath := filepath.Join(config.Directory, ".gitignore")
-	ignorePatterns, err := LoadGitignore(gitignorePath)
+// collectFiles selects the files to include, relative to config.Directory, along with the directory tree lines
+func collectFiles(config Config) ([]string, []string, error) {
+	args, err := diffArgs(config)
 	if err != nil {
-		return 0, fmt.Errorf("error loading .gitignore: %v", err)
+		return nil, nil, err
+	}
+	files, treeLines, err := collectAllFiles(config)
+	if err != nil || args == nil {
+		return files, treeLines, err
+	}
+
+	// Narrow the selection to changed files when a diff mode is set
+	changed, err := GitChangedFiles(config.Directory, args)
+	if err != nil {
+		return nil, nil, err
+	}
+	changedSet := map[string]bool{}
+	for _, p := range changed {
+		changedSet[p] = true
+	}
+	var changedFiles []string
+	for _, p := range files {
+		if changedSet[p] {
+			changedFiles = append(changedFiles, p)
+		}
+	}
+	return changedFiles, GenerateTreeFromPaths(filepath.Base(config.Directory), changedFiles), nil
+}
+
+// collectAllFiles selects every non-ignored file, from the git index or by walking the directory
+func collectAllFiles(config Config) ([]string, []string, error) {
+	if config.GitTracked {
+		files, err := collectGitFiles(config)
+		if err == nil {
+			return files, GenerateTreeFromPaths(filepath.Base(config.Directory), files), nil
+		}
+		fmt.Fprintf(os.Stderr, "Falling back to directory walk: %v\n", err)
+	}
+
+	// Load ignore layers
+	ignores, err := NewIgnoreStack(config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error loading ignore files: %v", err)
 	}
-	ignorePatterns = append(ignorePatterns, config.Omit...)
 
-	// Collect all files
 	var allFiles []string
 	err = filepath.Walk(config.Directory, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 		relPath, _ := filepath.Rel(config.Directory, path)
+		if relPath == "." {
+			return nil
+		}
+		d := decidePath(ignores, relPath, info.IsDir())
 		if info.IsDir() {
-			if IsIgnored(relPath, true, ignorePatterns) {
+			if !d.Included {
+				explainDecision(config, d)
 				return filepath.SkipDir
 			}
 		} else {
-			if !IsIgnored(relPath, false, ignorePatterns) {
+			explainDecision(config, d)
+			if d.Included {
 				allFiles = append(allFiles, relPath)
 			}
 		}
 		return nil
 	})
 	if err != nil {
-		return 0, fmt.Errorf("error walking directory: %v", err)
+		return nil, nil, fmt.Errorf("error walking directory: %v", err)
 	}
+	return allFiles, generateTree(config.Directory, ignores, "", config.Directory), nil
+}
 
-	// Write UTF-8 BOM
-	_, err = cw.Write([]byte{0xEF, 0xBB, 0xBF})
+// collectGitFiles lists files from the git index, filtered by omit, include and .contextifyignore rules
+func collectGitFiles(config Config) ([]string, error) {
+	repo, err := FindGitRepo(config.Directory)
 	if err != nil {
-		return 0, fmt.Errorf("error writing BOM: %v", err)
+		return nil, err
 	}
-
-	// Write preprompt
-	_, err = cw.Write([]byte(config.Preprompt))
+	if repo == nil {
+		return nil, fmt.Errorf("%s is not a git repository", config.Directory)
+	}
+	listed, err := GitListFiles(config.Directory, config.GitUntracked)
 	if err != nil {
-		return 0, fmt.Errorf("error writing preprompt: %v", err)
+		return nil, err
 	}
 
-	// Write directory structure
-	_, err = cw.Write([]byte("Directory structure:\n"))
+	// Git already applied its own ignore rules when listing
+	config.NoGitignore, config.NoGitExclude, config.NoGlobalExcludes = true, true, true
+	ignores, err := NewIgnoreStack(config)
 	if err != nil {
-		return 0, fmt.Errorf("error writing directory header: %v", err)
+		return nil, fmt.Errorf("error loading ignore files: %v", err)
 	}
-	treeLines := GenerateTree(config.Directory, ignorePatterns, "", config.Directory)
-	treeStr := strings.Join(treeLines, "\n") + "\n\n"
-	_, err = cw.Write([]byte(treeStr))
-	if err != nil {
-		return 0, fmt.Errorf("error writing directory tree: %v", err)
+
+	var files []string
+	for _, relPath := range listed {
+		info, err := os.Stat(filepath.Join(config.Directory, relPath))
+		if err != nil || info.IsDir() {
+			// Deleted files and submodules have no content to include
+			continue
+		}
+		d := decidePath(ignores, relPath, false)
+		explainDecision(config, d)
+		if d.Included {
+			files = append(files, relPath)
+		}
 	}
+	return files, nil
+}
 
-	// Write file contents header
-	_, err = cw.Write([]byte("File contents:\n\n"))
-	if err != nil {
-		return 0, fmt.Errorf("error writing contents header: %v", err)
+// GenerateTreeFromPaths generates a directory tree structure from a list of relative file paths
+func GenerateTreeFromPaths(rootName string, paths []string) []string {
+	root := &treeNode{name: rootName, isDir: true}
+	for _, p := range paths {
+		node := root
+		parts := strings.Split(filepath.ToSlash(p), "/")
+		for i, part := range parts {
+			isDir := i < len(parts)-1
+			var child *treeNode
+			for _, existing := range node.children {
+				if existing.name == part && existing.isDir == isDir {
+					child = existing
+					break
+				}
+			}
+			if child == nil {
+				child = &treeNode{name: part, isDir: isDir}
+				node.children = append(node.children, child)
+			}
+			node = child
+		}
 	}
+	return append([]string{rootName}, renderTree(root, "")...)
+}
+
+// sourceFile is a selected file as read from disk
+type sourceFile struct {
+	stats    FileStats
+	content  []byte // Content as written, after transforms such as line numbering
+	language string
+	tokens   int    // Tokens in the content alone, without framing
+	sha256   string // Hex digest of the file on disk
+	mode     os.FileMode
+	modTime  time.Time
+}
+
+// output returns the file as handed to a Formatter
+func (f sourceFile) output() File {
+	return File{
+		Path:     f.stats.Path,
+		Content:  f.content,
+		Language: f.language,
+		Size:     f.stats.Bytes,
+		Mode:     f.mode,
+		SHA256:   f.sha256,
+		Tokens:   f.tokens,
+	}
+}
+
+// readFiles reads the selected files, redacts or skips possible secrets and measures the formatted size of
+// each file, recording binary and unreadable files as skipped
+func readFiles(config Config, allFiles []string, tokenizer Tokenizer, newFormatter func() Formatter) ([]sourceFile, []SecretFinding) {
+	action, _ := secretsAction(config)
 
-	// Process files with progress bar
 	bar := pb.New(len(allFiles))
 	bar.SetWriter(os.Stderr)
 	bar.Set("desc", "Combining files")
 	bar.Start()
 	defer bar.Finish()
 
+	var files []sourceFile
+	var findings []SecretFinding
 	for _, relPath := range allFiles {
 		fullPath := filepath.Join(config.Directory, relPath)
 		if IsBinaryFile(fullPath) {
-			fmt.Fprintf(os.Stderr, "Skipping binary file: %s\n", relPath)
+			if config.Explain {
+				explainDecision(config, PathDecision{Path: filepath.ToSlash(relPath), Reason: SkipBinary})
+			} else {
+				fmt.Fprintf(os.Stderr, "Skipping binary file: %s\n", relPath)
+			}
+			stats := FileStats{Path: relPath, Skipped: SkipBinary}
+			if info, err := os.Stat(fullPath); err == nil {
+				stats.Bytes = int(info.Size())
+			}
+			files = append(files, sourceFile{stats: stats})
 			bar.Increment()
 			continue
 		}
@@ -373,24 +575,187 @@ func ProcessDirectory(config Config, writer io.Writer) (int, error) {
 			} else {
 				fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", relPath, err)
 			}
+			files = append(files, sourceFile{stats: FileStats{Path: relPath, Skipped: SkipUnreadable}})
 			bar.Increment()
 			continue
 		}
-		header := fmt.Sprintf("=== File: %s ===\n", relPath)
-		_, err = cw.Write([]byte(header))
-		if err != nil {
-			return 0, fmt.Errorf("error writing file header for %s: %v", relPath, err)
+		sum := sha256.Sum256(content)
+		file := sourceFile{
+			stats: FileStats{
+				Path:  relPath,
+				Bytes: len(content),
+				Lines: countLines(content),
+			},
+			language: DetectLanguage(relPath, content),
+			sha256:   hex.EncodeToString(sum[:]),
+		}
+		if !config.NoRedact {
+			if found := ScanSecrets(relPath, content); len(found) > 0 {
+				findings = append(findings, found...)
+				if action == SecretsSkip {
+					file.stats.Skipped = SkipSecret
+					files = append(files, sourceFile{stats: file.stats})
+					bar.Increment()
+					continue
+				}
+				content = redactSecrets(content, found)
+			}
 		}
-		_, err = cw.Write(content)
+		content, file.stats.SavedTokens = transformContent(config, relPath, file.language, content, tokenizer)
+		file.content = content
+		file.tokens = tokenizer.CountTokens(string(content))
+		if info, err := os.Stat(fullPath); err == nil {
+			file.mode = info.Mode()
+			file.modTime = info.ModTime()
+		}
+		file.stats.Tokens = tokenizer.CountTokens(renderItem(newFormatter, fileItem(file.output())))
+		files = append(files, file)
+		bar.Increment()
+	}
+	return files, findings
+}
+
+// document is everything that goes into the output, kept in pieces so it can be written whole or split into parts
+type document struct {
+	newFormatter func() Formatter
+	preamble     Preamble
+	tree         []string
+	files        []sourceFile // Selected files in output order, including skipped ones
+	sections     []Section    // Trailing sections such as the diff and omitted files
+	dropped      []sourceFile // Files left out by packing
+	secrets      []SecretFinding
+}
+
+// buildDocument selects and reads everything that goes into the output
+func buildDocument(config Config, tokenizer Tokenizer) (*document, error) {
+	newFormatter, err := lookupFormatter(config.OutputFormat)
+	if err != nil {
+		return nil, err
+	}
+	action, err := secretsAction(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Collect all files
+	allFiles, treeLines, err := collectFiles(config)
+	if err != nil {
+		return nil, err
+	}
+	doc := &document{
+		newFormatter: newFormatter,
+		preamble:     Preamble{Preprompt: config.Preprompt, Template: config.PrepromptTemplate, Request: config.Request},
+		tree:         treeLines,
+	}
+
+	doc.files, doc.secrets = readFiles(config, allFiles, tokenizer, newFormatter)
+
+	// The diff itself follows the file contents; it carries the same secrets as the files it covers
+	if config.IncludeDiff {
+		args, _ := diffArgs(config)
+		diff, err := GitDiff(config.Directory, args, allFiles)
 		if err != nil {
-			return 0, fmt.Errorf("error writing file content for %s: %v", relPath, err)
+			return nil, err
+		}
+		if diff != "" && !config.NoRedact {
+			if found := ScanSecrets(DiffSecretPath, []byte(diff)); len(found) > 0 {
+				doc.secrets = append(doc.secrets, found...)
+				if action == SecretsSkip {
+					diff = ""
+				} else {
+					diff = string(redactSecrets([]byte(diff), found))
+				}
+			}
 		}
-		_, err = cw.Write([]byte("\n\n"))
+		if diff != "" {
+			doc.sections = append(doc.sections, Section{Title: "Diff", Body: diff, Language: "diff"})
+		}
+	}
+
+	if len(doc.secrets) > 0 {
+		writeSecretsSummary(os.Stderr, action, doc.secrets)
+		if action == SecretsAbort {
+			return nil, fmt.Errorf("aborted because of possible secrets")
+		}
+	}
+
+	// Drop files that do not fit within the token limit
+	if config.Pack {
+		overhead := tokenizer.CountTokens(doc.render(doc.preamble, doc.tree, doc.sectionItems()))
+		doc.files, doc.dropped, err = packFiles(config, doc.files, overhead, tokenizer, newFormatter)
 		if err != nil {
-			return 0, fmt.Errorf("error writing file footer for %s: %v", relPath, err)
+			return nil, err
 		}
-		bar.Increment()
+		if len(doc.dropped) > 0 {
+			doc.sections = append(doc.sections, omittedTrailer(config, doc.dropped))
+		}
+	}
+	return doc, nil
+}
+
+// fileItems returns the body items for the selected files, in order
+func (d *document) fileItems() []docItem {
+	var items []docItem
+	for _, file := range d.files {
+		if file.stats.Skipped != "" {
+			items = append(items, skippedItem(file.stats))
+		} else {
+			items = append(items, fileItem(file.output()))
+		}
+	}
+	return items
+}
+
+// sectionItems returns the body items for the trailing sections
+func (d *document) sectionItems() []docItem {
+	var items []docItem
+	for _, s := range d.sections {
+		items = append(items, sectionItem(s))
+	}
+	return items
+}
+
+// render renders a document with the given preamble, tree and body using a fresh formatter
+func (d *document) render(p Preamble, tree []string, items []docItem) string {
+	var b strings.Builder
+	writeDocument(&b, d.newFormatter(), p, tree, items)
+	return b.String()
+}
+
+// fileStats lists the stats of every selected file, including those dropped by packing
+func (d *document) fileStats() []FileStats {
+	var files []FileStats
+	for _, file := range d.files {
+		files = append(files, file.stats)
+	}
+	for _, file := range d.dropped {
+		files = append(files, file.stats)
+	}
+	return files
+}
+
+// ProcessDirectory processes the directory and writes output to writer, returning statistics about what was written
+func ProcessDirectory(config Config, writer io.Writer) (*Stats, error) {
+	tokenizer, err := NewTokenizer(config.Tokenizer)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := buildDocument(config, tokenizer)
+	if err != nil {
+		return nil, err
+	}
+
+	cw := &countingWriter{writer: writer, tokenizer: tokenizer}
+	items := append(doc.fileItems(), doc.sectionItems()...)
+	if err := writeDocument(cw, doc.newFormatter(), doc.preamble, doc.tree, items); err != nil {
+		return nil, err
 	}
 
-	return cw.count, nil
+	return &Stats{
+		Tokenizer:   tokenizer.Name(),
+		TotalChars:  cw.count,
+		TotalTokens: cw.tokens,
+		Files:       doc.fileStats(),
+		Secrets:     doc.secrets,
+	}, nil
 }
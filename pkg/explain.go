@@ -0,0 +1,74 @@
+package contextify
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// AutoOmitSource is the source of Config.AutoOmit rules
+const AutoOmitSource = "auto-ignored"
+
+// PathDecision records whether a path is selected and what decided it
+type PathDecision struct {
+	Path     string
+	Included bool
+	Rule     *IgnoreRule // Deciding ignore rule, nil when no pattern matched
+	Reason   string      // Why the path was skipped when no rule decided it, such as "binary"
+}
+
+// String formats the decision as "path: skipped: source:line (pattern)"
+func (d PathDecision) String() string {
+	verdict := "included"
+	if !d.Included {
+		verdict = "skipped"
+	}
+	switch {
+	case d.Reason != "":
+		return fmt.Sprintf("%s: %s: %s", d.Path, verdict, d.Reason)
+	case d.Rule != nil:
+		return fmt.Sprintf("%s: %s: %s (%s)", d.Path, verdict, d.Rule.Origin(), d.Rule.Pattern)
+	default:
+		return fmt.Sprintf("%s: %s", d.Path, verdict)
+	}
+}
+
+// decidePath applies the ignore layers and the include list to a path relative to the processed directory
+func decidePath(ignores *IgnoreStack, relPath string, isDir bool) PathDecision {
+	ignored, rule := ignores.Match(relPath, isDir)
+	d := PathDecision{Path: filepath.ToSlash(relPath), Included: !ignored, Rule: rule}
+	if isDir {
+		d.Path += "/"
+	} else if !ignored && !ignores.Includes(relPath) {
+		d.Included, d.Reason = false, "not matched by include"
+	}
+	return d
+}
+
+// explainDecision prints a selection decision to stderr when the config asks for it
+func explainDecision(config Config, d PathDecision) {
+	if config.Explain {
+		fmt.Fprintln(os.Stderr, d)
+	}
+}
+
+// CheckIgnore decides each path, relative to config.Directory, the way a run would: ignore layers, the
+// include list and binary detection. Paths need not exist; missing ones are treated as files.
+func CheckIgnore(config Config, paths []string) ([]PathDecision, error) {
+	ignores, err := NewIgnoreStack(config)
+	if err != nil {
+		return nil, fmt.Errorf("error loading ignore files: %v", err)
+	}
+	var decisions []PathDecision
+	for _, relPath := range paths {
+		fullPath := filepath.Join(config.Directory, relPath)
+		info, err := os.Stat(fullPath)
+		isDir := err == nil && info.IsDir()
+		d := decidePath(ignores, relPath, isDir)
+		if d.Included && err == nil && !isDir && IsBinaryFile(fullPath) {
+			d.Included, d.Reason = false, SkipBinary
+		}
+		decisions = append(decisions, d)
+	}
+	return decisions, nil
+}
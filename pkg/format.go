@@ -0,0 +1,362 @@
+package contextify
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Output formats accepted in Config.OutputFormat
+const (
+	FormatText     = "text"
+	FormatMarkdown = "markdown"
+	FormatXML      = "xml"
+	FormatJSON     = "json"
+	FormatJSONL    = "jsonl"
+)
+
+// Formatter renders an output document. ProcessDirectory calls BeginDocument, WritePreamble and
+// WriteTree, then WriteFile, WriteSkipped and WriteSection for the body, and finally EndDocument.
+// A Formatter may keep state between calls, so a fresh one is created for every document and for
+// every part of a split output.
+type Formatter interface {
+	BeginDocument(w io.Writer) error
+	WritePreamble(w io.Writer, p Preamble) error
+	WriteTree(w io.Writer, lines []string) error // lines is nil when an earlier part already carried the tree
+	WriteFile(w io.Writer, file File) error
+	WriteSkipped(w io.Writer, file FileStats) error // Binary and unreadable files
+	WriteSection(w io.Writer, s Section) error      // Trailing sections, after every file
+	EndDocument(w io.Writer) error
+}
+
+// Preamble is the text placed before the tree
+type Preamble struct {
+	Preprompt   string // Preprompt with the request already substituted
+	Template    string // Preprompt before substitution, empty when it is not known
+	Request     string
+	Part, Parts int // Position of this part when the output is split, otherwise zero
+}
+
+// File is a file, or a range of its lines, as handed to a Formatter
+type File struct {
+	Path      string
+	Content   []byte
+	Language  string // Code fence language tag from DetectLanguage
+	Size      int    // Size of the whole file in bytes
+	Mode      os.FileMode
+	SHA256    string // Hex digest of the whole file
+	Tokens    int    // Estimated tokens in Content
+	FirstLine int    // Line range when only part of the file is included, otherwise zero
+	LastLine  int
+}
+
+// Label names the file along with its line range, if any
+func (f File) Label() string {
+	if f.FirstLine == 0 {
+		return f.Path
+	}
+	return fmt.Sprintf("%s (lines %d-%d)", f.Path, f.FirstLine, f.LastLine)
+}
+
+// Section is a titled block following the file contents, such as the diff or the omitted files
+type Section struct {
+	Title    string
+	Body     string
+	Language string // Highlighting hint for formats that fence the body; empty for prose
+}
+
+var (
+	formattersMu sync.RWMutex
+	formatters   = map[string]func() Formatter{
+		FormatText:     func() Formatter { return &textFormatter{} },
+		FormatMarkdown: func() Formatter { return &markdownFormatter{} },
+		FormatXML:      func() Formatter { return &xmlFormatter{} },
+		FormatJSON:     func() Formatter { return &jsonFormatter{} },
+		FormatJSONL:    func() Formatter { return &jsonFormatter{lines: true} },
+	}
+)
+
+// RegisterFormatter makes a custom output format available under name in Config.OutputFormat;
+// newFormatter is called once per document. Registering an existing name replaces it.
+func RegisterFormatter(name string, newFormatter func() Formatter) {
+	formattersMu.Lock()
+	defer formattersMu.Unlock()
+	formatters[name] = newFormatter
+}
+
+// lookupFormatter returns the constructor for the named output format, defaulting to text
+func lookupFormatter(name string) (func() Formatter, error) {
+	if name == "" {
+		name = FormatText
+	}
+	formattersMu.RLock()
+	defer formattersMu.RUnlock()
+	if newFormatter, ok := formatters[name]; ok {
+		return newFormatter, nil
+	}
+	var names []string
+	for known := range formatters {
+		names = append(names, known)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("unknown output format %q (expected one of %s)", name, strings.Join(names, ", "))
+}
+
+// textFormatter writes the plain text format with "=== File: ===" headers
+type textFormatter struct{}
+
+func (t *textFormatter) BeginDocument(w io.Writer) error {
+	_, err := io.WriteString(w, "\xEF\xBB\xBF")
+	return err
+}
+
+func (t *textFormatter) WritePreamble(w io.Writer, p Preamble) error {
+	text := p.Preprompt
+	if p.Parts > 0 {
+		text += fmt.Sprintf("[Part %d of %d]\n\n", p.Part, p.Parts)
+	}
+	_, err := io.WriteString(w, text)
+	return err
+}
+
+func (t *textFormatter) WriteTree(w io.Writer, lines []string) error {
+	text := "File contents:\n\n"
+	if lines != nil {
+		text = "Directory structure:\n" + strings.Join(lines, "\n") + "\n\n" + text
+	}
+	_, err := io.WriteString(w, text)
+	return err
+}
+
+func (t *textFormatter) WriteFile(w io.Writer, file File) error {
+	_, err := fmt.Fprintf(w, "=== File: %s ===\n%s\n\n", file.Label(), file.Content)
+	return err
+}
+
+func (t *textFormatter) WriteSkipped(w io.Writer, file FileStats) error {
+	return nil
+}
+
+func (t *textFormatter) WriteSection(w io.Writer, s Section) error {
+	_, err := fmt.Fprintf(w, "%s:\n\n%s\n", s.Title, s.Body)
+	return err
+}
+
+func (t *textFormatter) EndDocument(w io.Writer) error {
+	return nil
+}
+
+// markdownFormatter writes a Markdown document with a heading and fenced code block per file
+type markdownFormatter struct{}
+
+func (m *markdownFormatter) BeginDocument(w io.Writer) error {
+	_, err := io.WriteString(w, "\xEF\xBB\xBF")
+	return err
+}
+
+func (m *markdownFormatter) WritePreamble(w io.Writer, p Preamble) error {
+	text := p.Preprompt
+	if p.Parts > 0 {
+		text += fmt.Sprintf("**Part %d of %d**\n\n", p.Part, p.Parts)
+	}
+	_, err := io.WriteString(w, text)
+	return err
+}
+
+func (m *markdownFormatter) WriteTree(w io.Writer, lines []string) error {
+	text := "## File contents\n\n"
+	if lines != nil {
+		text = "## Directory structure\n\n" + fenced(strings.Join(lines, "\n"), "") + "\n" + text
+	}
+	_, err := io.WriteString(w, text)
+	return err
+}
+
+func (m *markdownFormatter) WriteFile(w io.Writer, file File) error {
+	_, err := fmt.Fprintf(w, "### %s\n\n%s\n", markdownCode(file.Label()), fenced(string(file.Content), file.Language))
+	return err
+}
+
+func (m *markdownFormatter) WriteSkipped(w io.Writer, file FileStats) error {
+	return nil
+}
+
+func (m *markdownFormatter) WriteSection(w io.Writer, s Section) error {
+	body := s.Body
+	if s.Language != "" {
+		body = fenced(body, s.Language)
+	}
+	_, err := fmt.Fprintf(w, "## %s\n\n%s\n", s.Title, body)
+	return err
+}
+
+func (m *markdownFormatter) EndDocument(w io.Writer) error {
+	return nil
+}
+
+// fenced wraps text in a code fence longer than any run of backticks inside it
+func fenced(text, language string) string {
+	fence := strings.Repeat("`", longestRun(text, '`')+1)
+	if len(fence) < 3 {
+		fence = "```"
+	}
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	return fence + language + "\n" + text + fence + "\n"
+}
+
+// markdownCode renders text as inline code, using enough backticks to enclose any inside it
+func markdownCode(text string) string {
+	fence := strings.Repeat("`", longestRun(text, '`')+1)
+	if strings.HasPrefix(text, "`") || strings.HasSuffix(text, "`") {
+		text = " " + text + " "
+	}
+	return fence + text + fence
+}
+
+// longestRun returns the length of the longest run of c in text
+func longestRun(text string, c byte) int {
+	longest, run := 0, 0
+	for i := 0; i < len(text); i++ {
+		if text[i] != c {
+			run = 0
+			continue
+		}
+		run++
+		if run > longest {
+			longest = run
+		}
+	}
+	return longest
+}
+
+// languageByExtension maps file extensions to common code fence language tags
+var languageByExtension = map[string]string{
+	".bash": "bash", ".c": "c", ".cc": "cpp", ".clj": "clojure", ".cpp": "cpp", ".cs": "csharp",
+	".css": "css", ".cxx": "cpp", ".dart": "dart", ".diff": "diff", ".erl": "erlang", ".ex": "elixir",
+	".exs": "elixir", ".fish": "fish", ".go": "go", ".gradle": "groovy", ".graphql": "graphql",
+	".groovy": "groovy", ".h": "c", ".hpp": "cpp", ".hs": "haskell", ".html": "html", ".ini": "ini",
+	".java": "java", ".js": "javascript", ".json": "json", ".jsx": "jsx", ".kt": "kotlin", ".kts": "kotlin",
+	".lua": "lua", ".m": "objectivec", ".md": "markdown", ".mjs": "javascript", ".ml": "ocaml",
+	".patch": "diff", ".php": "php", ".pl": "perl", ".proto": "protobuf", ".ps1": "powershell",
+	".py": "python", ".r": "r", ".rb": "ruby", ".rs": "rust", ".scala": "scala", ".scss": "scss",
+	".sh": "bash", ".sql": "sql", ".svelte": "svelte", ".swift": "swift", ".tf": "hcl", ".toml": "toml",
+	".ts": "typescript", ".tsx": "tsx", ".vue": "vue", ".xml": "xml", ".yaml": "yaml", ".yml": "yaml",
+	".zig": "zig", ".zsh": "zsh",
+}
+
+// languageByName maps well-known file names without a telling extension
+var languageByName = map[string]string{
+	"Dockerfile": "dockerfile", "Makefile": "makefile", "GNUmakefile": "makefile", "CMakeLists.txt": "cmake",
+	"Gemfile": "ruby", "Rakefile": "ruby", "go.mod": "go", "Jenkinsfile": "groovy",
+}
+
+// languageByInterpreter maps shebang interpreters to language tags
+var languageByInterpreter = map[string]string{
+	"sh": "bash", "bash": "bash", "zsh": "zsh", "fish": "fish", "python": "python", "ruby": "ruby",
+	"node": "javascript", "deno": "typescript", "perl": "perl", "php": "php", "lua": "lua", "Rscript": "r",
+}
+
+// DetectLanguage guesses the code fence language of a file from its name or, failing that, its shebang line;
+// it returns an empty string when the language is unknown
+func DetectLanguage(path string, content []byte) string {
+	base := filepath.Base(path)
+	if language, ok := languageByName[base]; ok {
+		return language
+	}
+	if language, ok := languageByExtension[strings.ToLower(filepath.Ext(base))]; ok {
+		return language
+	}
+	if !strings.HasPrefix(string(content), "#!") {
+		return ""
+	}
+	line := string(content[2:])
+	if end := strings.IndexByte(line, '\n'); end >= 0 {
+		line = line[:end]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return ""
+	}
+	interpreter := filepath.Base(fields[0])
+	if interpreter == "env" {
+		// Skip env's own options, as in "#!/usr/bin/env -S python3 -u"
+		interpreter = ""
+		for _, field := range fields[1:] {
+			if !strings.HasPrefix(field, "-") && !strings.Contains(field, "=") {
+				interpreter = filepath.Base(field)
+				break
+			}
+		}
+	}
+	// Strip version suffixes such as python3 or python3.12
+	interpreter = strings.TrimRight(interpreter, "0123456789.")
+	return languageByInterpreter[interpreter]
+}
+
+// docItem writes one file, skipped notice or section of the document body
+type docItem func(f Formatter, w io.Writer) error
+
+// fileItem writes a file's content
+func fileItem(file File) docItem {
+	return func(f Formatter, w io.Writer) error {
+		if err := f.WriteFile(w, file); err != nil {
+			return fmt.Errorf("error writing file %s: %v", file.Path, err)
+		}
+		return nil
+	}
+}
+
+// skippedItem notes a file that was selected but left out
+func skippedItem(file FileStats) docItem {
+	return func(f Formatter, w io.Writer) error {
+		if err := f.WriteSkipped(w, file); err != nil {
+			return fmt.Errorf("error writing skipped file %s: %v", file.Path, err)
+		}
+		return nil
+	}
+}
+
+// sectionItem writes a trailing section
+func sectionItem(s Section) docItem {
+	return func(f Formatter, w io.Writer) error {
+		if err := f.WriteSection(w, s); err != nil {
+			return fmt.Errorf("error writing trailing section: %v", err)
+		}
+		return nil
+	}
+}
+
+// writeDocument writes a complete document with a single formatter
+func writeDocument(w io.Writer, f Formatter, p Preamble, tree []string, items []docItem) error {
+	if err := f.BeginDocument(w); err != nil {
+		return fmt.Errorf("error writing preamble: %v", err)
+	}
+	if err := f.WritePreamble(w, p); err != nil {
+		return fmt.Errorf("error writing preamble: %v", err)
+	}
+	if err := f.WriteTree(w, tree); err != nil {
+		return fmt.Errorf("error writing directory tree: %v", err)
+	}
+	for _, item := range items {
+		if err := item(f, w); err != nil {
+			return err
+		}
+	}
+	if err := f.EndDocument(w); err != nil {
+		return fmt.Errorf("error finishing document: %v", err)
+	}
+	return nil
+}
+
+// renderItem renders a single item with a fresh formatter, for measuring its size
+func renderItem(newFormatter func() Formatter, item docItem) string {
+	var b strings.Builder
+	item(newFormatter(), &b)
+	return b.String()
+}
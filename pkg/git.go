@@ -0,0 +1,253 @@
+package contextify
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// GitRepo describes the on-disk layout of a git repository
+type GitRepo struct {
+	Root      string // Top-level directory of the working tree
+	GitDir    string // Repository directory (.git, or the target of a .git file for worktrees and submodules)
+	CommonDir string // Directory holding shared state such as info/exclude
+}
+
+// FindGitRepo walks upward from dir looking for a .git entry, returning nil if dir is not inside a repository
+func FindGitRepo(dir string) (*GitRepo, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving directory: %v", err)
+	}
+	for current := absDir; ; {
+		dotGit := filepath.Join(current, ".git")
+		if info, err := os.Stat(dotGit); err == nil {
+			repo := &GitRepo{Root: current, GitDir: dotGit, CommonDir: dotGit}
+			if !info.IsDir() {
+				// Worktrees and submodules use a file pointing at the real git directory
+				gitDir, err := readGitFile(dotGit)
+				if err != nil {
+					return nil, err
+				}
+				repo.GitDir = gitDir
+				repo.CommonDir = gitDir
+				if common, err := ioutil.ReadFile(filepath.Join(gitDir, "commondir")); err == nil {
+					commonDir := strings.TrimSpace(string(common))
+					if !filepath.IsAbs(commonDir) {
+						commonDir = filepath.Join(gitDir, commonDir)
+					}
+					repo.CommonDir = filepath.Clean(commonDir)
+				}
+			}
+			return repo, nil
+		}
+		parent := filepath.Dir(current)
+		if parent == current {
+			return nil, nil
+		}
+		current = parent
+	}
+}
+
+// GitListFiles lists the files in the git index under dir relative to dir, like git ls-files,
+// optionally adding untracked files that are not ignored
+func GitListFiles(dir string, untracked bool) ([]string, error) {
+	args := []string{"ls-files", "-z", "--cached"}
+	if untracked {
+		args = append(args, "--others", "--exclude-standard")
+	}
+	out, err := runGit(dir, args...)
+	if err != nil {
+		return nil, err
+	}
+	return splitGitPaths(out), nil
+}
+
+// GitChangedFiles lists the files under dir changed by the given diff arguments, relative to dir; deleted files are omitted
+func GitChangedFiles(dir string, diffArgs []string) ([]string, error) {
+	args := append([]string{"diff", "--name-only", "-z", "--relative", "--diff-filter=d", "--no-ext-diff"}, diffArgs...)
+	out, err := runGit(dir, args...)
+	if err != nil {
+		return nil, err
+	}
+	return splitGitPaths(out), nil
+}
+
+// GitDiff returns the unified diff for the given diff arguments, limited to paths relative to dir; with no
+// paths the diff is empty rather than covering every change
+func GitDiff(dir string, diffArgs []string, paths []string) (string, error) {
+	if len(paths) == 0 {
+		return "", nil
+	}
+	args := append([]string{"--literal-pathspecs", "diff", "--relative", "--no-color", "--no-ext-diff"}, diffArgs...)
+	args = append(args, "--")
+	for _, p := range paths {
+		args = append(args, filepath.ToSlash(p))
+	}
+	return runGit(dir, args...)
+}
+
+// runGit runs a git subcommand in dir and returns its standard output
+func runGit(dir string, args ...string) (string, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return "", fmt.Errorf("git executable not found")
+	}
+	var stderr strings.Builder
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		name := args[0]
+		if name == "--literal-pathspecs" {
+			name = args[1]
+		}
+		return "", fmt.Errorf("error running git %s: %v: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// splitGitPaths splits NUL-separated git output into unique native paths
+func splitGitPaths(out string) []string {
+	var files []string
+	seen := map[string]bool{}
+	for _, entry := range strings.Split(out, "\x00") {
+		// Unmerged paths are listed once per stage
+		if entry == "" || seen[entry] {
+			continue
+		}
+		seen[entry] = true
+		files = append(files, filepath.FromSlash(entry))
+	}
+	return files
+}
+
+// readGitFile resolves the "gitdir: <path>" line of a .git file
+func readGitFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading %s: %v", path, err)
+	}
+	line := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(line, "gitdir:") {
+		return "", fmt.Errorf("invalid .git file %s", path)
+	}
+	gitDir := strings.TrimSpace(strings.TrimPrefix(line, "gitdir:"))
+	if !filepath.IsAbs(gitDir) {
+		gitDir = filepath.Join(filepath.Dir(path), gitDir)
+	}
+	return filepath.Clean(gitDir), nil
+}
+
+// GlobalExcludesFile returns the path of the user's global excludes file, following git's
+// lookup of core.excludesFile in the global, XDG and repository config files and falling
+// back to $XDG_CONFIG_HOME/git/ignore
+func GlobalExcludesFile(repo *GitRepo) string {
+	home, _ := os.UserHomeDir()
+	xdgConfig := xdgConfigHome()
+
+	// Later files take precedence, matching git's system < global < local order. GIT_CONFIG_GLOBAL replaces
+	// both the XDG and home config files.
+	var configFiles []string
+	if global := os.Getenv("GIT_CONFIG_GLOBAL"); global != "" {
+		configFiles = append(configFiles, global)
+	} else {
+		if xdgConfig != "" {
+			configFiles = append(configFiles, filepath.Join(xdgConfig, "git", "config"))
+		}
+		if home != "" {
+			configFiles = append(configFiles, filepath.Join(home, ".gitconfig"))
+		}
+	}
+	if repo != nil {
+		configFiles = append(configFiles, filepath.Join(repo.CommonDir, "config"))
+	}
+
+	excludesFile := ""
+	for _, configFile := range configFiles {
+		if value, ok := readGitConfigValue(configFile, "core", "excludesfile"); ok {
+			excludesFile = value
+		}
+	}
+	if excludesFile == "" {
+		if xdgConfig == "" {
+			return ""
+		}
+		return filepath.Join(xdgConfig, "git", "ignore")
+	}
+	if strings.HasPrefix(excludesFile, "~/") && home != "" {
+		excludesFile = filepath.Join(home, excludesFile[2:])
+	}
+	return excludesFile
+}
+
+// readGitConfigValue returns the last value of section.key in a git config file; section and key are case-insensitive
+func readGitConfigValue(path, section, key string) (string, bool) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", false
+	}
+	defer file.Close()
+
+	value, found := "", false
+	currentSection := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			end := strings.Index(line, "]")
+			if end < 0 {
+				continue
+			}
+			// Subsections ([remote "origin"]) never match a plain section name
+			currentSection = strings.ToLower(strings.TrimSpace(line[1:end]))
+			line = strings.TrimSpace(line[end+1:])
+			if line == "" {
+				continue
+			}
+		}
+		if currentSection != section {
+			continue
+		}
+		name, rawValue, hasValue := strings.Cut(line, "=")
+		if !strings.EqualFold(strings.TrimSpace(name), key) || !hasValue {
+			continue
+		}
+		value, found = parseGitConfigValue(rawValue), true
+	}
+	return value, found
+}
+
+// parseGitConfigValue strips inline comments and quotes from a raw git config value
+func parseGitConfigValue(raw string) string {
+	var b strings.Builder
+	inQuotes := false
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		switch {
+		case c == '"':
+			inQuotes = !inQuotes
+		case c == '\\' && i+1 < len(raw):
+			i++
+			switch raw[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			default:
+				b.WriteByte(raw[i])
+			}
+		case (c == '#' || c == ';') && !inQuotes:
+			return strings.TrimSpace(b.String())
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
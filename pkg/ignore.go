@@ -0,0 +1,470 @@
+package contextify
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Names of the per-directory ignore files
+const (
+	GitignoreFile        = ".gitignore"
+	ContextifyIgnoreFile = ".contextifyignore"
+)
+
+// IgnoreRule is a single parsed gitignore-style pattern
+type IgnoreRule struct {
+	Pattern  string // Pattern as written, used in diagnostics
+	Source   string // Where the rule came from (e.g. ".gitignore", "omit")
+	Line     int    // Line number within Source, 0 when not read from a file
+	Base     string // Slash-separated directory the rule is relative to, "" for the root
+	Negate   bool   // Pattern started with "!" and re-includes matches
+	DirOnly  bool   // Pattern ended with "/" and only matches directories
+	Anchored bool   // Pattern contained a "/" and only matches relative to its base
+	re       *regexp.Regexp
+}
+
+// ParseIgnoreRule parses one line of a gitignore-style file, returning false for blank lines and comments
+func ParseIgnoreRule(line, source string) (IgnoreRule, bool) {
+	rule := IgnoreRule{Pattern: line, Source: source}
+	line = strings.TrimSuffix(line, "\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule, false
+	}
+
+	// Trailing spaces are ignored unless escaped with a backslash
+	for strings.HasSuffix(line, " ") && !isEscaped(line, len(line)-1) {
+		line = line[:len(line)-1]
+	}
+	rule.Pattern = line
+
+	if strings.HasPrefix(line, "!") {
+		rule.Negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") && !isEscaped(line, len(line)-1) {
+		rule.DirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		rule.Anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return rule, false
+	}
+
+	expr := globToRegexp(line)
+	if !rule.Anchored {
+		expr = "(?:.*/)?" + expr
+	}
+	re, err := regexp.Compile("^" + expr + "$")
+	if err != nil {
+		return rule, false
+	}
+	rule.re = re
+	return rule, true
+}
+
+// Matches reports whether the rule matches a slash-separated path relative to the rule's base
+func (r IgnoreRule) Matches(path string, isDir bool) bool {
+	if r.DirOnly && !isDir {
+		return false
+	}
+	if r.Base != "" {
+		if !strings.HasPrefix(path, r.Base+"/") {
+			return false
+		}
+		path = path[len(r.Base)+1:]
+	}
+	return r.re.MatchString(path)
+}
+
+// LoadIgnoreFile parses a gitignore-style file whose rules are relative to base, returning no rules if it does not exist
+func LoadIgnoreFile(filePath, base, source string) ([]IgnoreRule, error) {
+	var rules []IgnoreRule
+	file, err := os.Open(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return rules, nil
+		}
+		return nil, fmt.Errorf("error opening %s: %v", source, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		if rule, ok := ParseIgnoreRule(scanner.Text(), source); ok {
+			rule.Line = lineNumber
+			rule.Base = base
+			rules = append(rules, rule)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", source, err)
+	}
+	return rules, nil
+}
+
+// isEscaped reports whether the byte at index i is preceded by an odd number of backslashes
+func isEscaped(s string, i int) bool {
+	n := 0
+	for j := i - 1; j >= 0 && s[j] == '\\'; j-- {
+		n++
+	}
+	return n%2 == 1
+}
+
+// globToRegexp translates a gitignore glob into a regular expression body
+func globToRegexp(pattern string) string {
+	var b strings.Builder
+	for i := 0; i < len(pattern); {
+		c := pattern[i]
+		switch c {
+		case '*':
+			j := i
+			for j < len(pattern) && pattern[j] == '*' {
+				j++
+			}
+			atStart := i == 0 || pattern[i-1] == '/'
+			atEnd := j == len(pattern) || pattern[j] == '/'
+			if j-i >= 2 && atStart && atEnd {
+				if j == len(pattern) {
+					// Trailing "/**" matches everything inside
+					b.WriteString(".*")
+				} else {
+					// Leading "**/" or inner "/**/" matches zero or more directories
+					b.WriteString("(?:.*/)?")
+					j++
+				}
+			} else {
+				b.WriteString("[^/]*")
+			}
+			i = j
+		case '?':
+			b.WriteString("[^/]")
+			i++
+		case '[':
+			if class, n := bracketToRegexp(pattern[i:]); n > 0 {
+				b.WriteString(class)
+				i += n
+			} else {
+				b.WriteString(`\[`)
+				i++
+			}
+		case '\\':
+			if i+1 < len(pattern) {
+				b.WriteString(regexp.QuoteMeta(pattern[i+1 : i+2]))
+				i += 2
+			} else {
+				b.WriteString(`\\`)
+				i++
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+			i++
+		}
+	}
+	return b.String()
+}
+
+// bracketToRegexp translates a bracket expression at the start of s, returning the regexp class and the number of bytes consumed (0 if unterminated)
+func bracketToRegexp(s string) (string, int) {
+	var body strings.Builder
+	i := 1
+	negate := false
+	if i < len(s) && (s[i] == '!' || s[i] == '^') {
+		negate = true
+		i++
+	}
+	if i < len(s) && s[i] == ']' {
+		body.WriteString(`\]`)
+		i++
+	}
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == ']':
+			if negate {
+				return "[^/" + body.String() + "]", i + 1
+			}
+			return "[" + body.String() + "]", i + 1
+		case c == '[' && i+1 < len(s) && s[i+1] == ':':
+			end := strings.Index(s[i+2:], ":]")
+			if end < 0 {
+				return "", 0
+			}
+			body.WriteString(s[i : i+2+end+2])
+			i += 2 + end + 2
+		case c == '\\' && i+1 < len(s):
+			body.WriteString(regexp.QuoteMeta(s[i+1 : i+2]))
+			i += 2
+		case c == '[' || c == '^' || c == '\\':
+			body.WriteString(`\` + string(c))
+			i++
+		default:
+			body.WriteByte(c)
+			i++
+		}
+	}
+	return "", 0
+}
+
+// Origin names where the rule came from, with its line number when it was read from a file
+func (r *IgnoreRule) Origin() string {
+	if r.Line > 0 {
+		return fmt.Sprintf("%s:%d", r.Source, r.Line)
+	}
+	return r.Source
+}
+
+// SensitiveSource is the source of rules from SensitiveDefaults
+const SensitiveSource = "sensitive default"
+
+// SensitiveDefaults are patterns for files that commonly hold credentials. They are ignored unless
+// Config.NoSensitiveDefaults is set or a negated omit or .contextifyignore pattern re-includes them.
+var SensitiveDefaults = []string{
+	"*.env", ".env", ".env.*", "!.env.example", "!.env.sample", "!.env.template",
+	"*.pem", "*.key", "*.p12", "*.pfx", "*.jks", "*.keystore",
+	"id_rsa*", "id_dsa*", "id_ecdsa*", "id_ed25519*", "!id_*.pub",
+	"**/.kube/config", "kubeconfig", "*.kubeconfig",
+	".npmrc", ".pypirc", ".netrc", ".git-credentials", "**/.aws/credentials", "**/.docker/config.json",
+	"*.tfstate", "*.tfstate.backup", ".htpasswd",
+}
+
+// IgnoreMatcher evaluates an ordered list of ignore rules where the last matching rule wins
+type IgnoreMatcher struct {
+	rules []IgnoreRule
+}
+
+// NewIgnoreMatcher creates a matcher from gitignore-style patterns attributed to source
+func NewIgnoreMatcher(patterns []string, source string) *IgnoreMatcher {
+	m := &IgnoreMatcher{}
+	m.Add(patterns, source)
+	return m
+}
+
+// Add appends patterns to the matcher; later patterns take precedence over earlier ones
+func (m *IgnoreMatcher) Add(patterns []string, source string) {
+	for _, pattern := range patterns {
+		if rule, ok := ParseIgnoreRule(pattern, source); ok {
+			m.rules = append(m.rules, rule)
+		}
+	}
+}
+
+// Match reports whether a path relative to the root is ignored, along with the deciding rule (nil if none matched)
+func (m *IgnoreMatcher) Match(path string, isDir bool) (bool, *IgnoreRule) {
+	return matchWithParents(path, isDir, func(p string, d bool) *IgnoreRule {
+		return m.find(p, d)
+	})
+}
+
+// find returns the last rule matching a single path, or nil
+func (m *IgnoreMatcher) find(path string, isDir bool) *IgnoreRule {
+	if m == nil {
+		return nil
+	}
+	for i := len(m.rules) - 1; i >= 0; i-- {
+		if m.rules[i].Matches(path, isDir) {
+			return &m.rules[i]
+		}
+	}
+	return nil
+}
+
+// matchWithParents normalizes path and applies find to each parent directory before the path itself
+func matchWithParents(p string, isDir bool, find func(string, bool) *IgnoreRule) (bool, *IgnoreRule) {
+	p = strings.Trim(filepath.ToSlash(filepath.Clean(p)), "/")
+	if p == "." || p == "" {
+		return false, nil
+	}
+
+	// A path inside an ignored directory can never be re-included
+	for i := 0; i < len(p); i++ {
+		if p[i] == '/' {
+			if rule := find(p[:i], true); rule != nil && !rule.Negate {
+				return true, rule
+			}
+		}
+	}
+	if rule := find(p, isDir); rule != nil {
+		return !rule.Negate, rule
+	}
+	return false, nil
+}
+
+// IgnoreStack layers ignore sources in git's order of precedence: contextify's own files and config
+// omit patterns, then per-directory ignore files from the deepest directory upwards
+// (.contextifyignore over .gitignore), then .git/info/exclude, then the user's global excludes
+// file, and finally the sensitive defaults, which git's own files cannot re-include. An optional include
+// list further narrows which files are selected.
+type IgnoreStack struct {
+	omit      *IgnoreMatcher
+	includes  *IgnoreMatcher
+	exclude   *IgnoreMatcher
+	global    *IgnoreMatcher
+	sensitive *IgnoreMatcher
+	repoRoot  string   // Directory that per-directory ignore files and git rules are relative to
+	prefix    string   // Slash-separated path of the processed directory within repoRoot
+	perDir    []string // Names of per-directory ignore files, lowest precedence first
+	nested    bool     // Whether .gitignore files outside the processed directory itself apply
+	dirs      map[string]*IgnoreMatcher
+}
+
+// NewIgnoreStack builds the ignore layers for config.Directory, honoring the config's layer toggles
+func NewIgnoreStack(config Config) (*IgnoreStack, error) {
+	s := &IgnoreStack{
+		omit:     NewIgnoreMatcher(config.Omit, "omit"),
+		repoRoot: config.Directory,
+		nested:   !config.NoNestedGitignore,
+		dirs:     map[string]*IgnoreMatcher{},
+	}
+	s.omit.Add(config.AutoOmit, AutoOmitSource)
+	if len(config.Include) > 0 {
+		s.includes = NewIgnoreMatcher(config.Include, "include")
+	}
+	if !config.NoSensitiveDefaults {
+		s.sensitive = NewIgnoreMatcher(SensitiveDefaults, SensitiveSource)
+	}
+	if !config.NoGitignore {
+		s.perDir = append(s.perDir, GitignoreFile)
+	}
+	s.perDir = append(s.perDir, ContextifyIgnoreFile)
+
+	repo, err := FindGitRepo(config.Directory)
+	if err != nil {
+		return nil, err
+	}
+	if repo == nil {
+		return s, nil
+	}
+
+	// Git rules are relative to the repository root, which may be above the processed directory
+	absDir, err := filepath.Abs(config.Directory)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving directory: %v", err)
+	}
+	prefix, err := filepath.Rel(repo.Root, absDir)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving directory within repository: %v", err)
+	}
+	s.repoRoot = repo.Root
+	if prefix != "." {
+		s.prefix = filepath.ToSlash(prefix)
+	}
+
+	if !config.NoGitExclude {
+		rules, err := LoadIgnoreFile(filepath.Join(repo.CommonDir, "info", "exclude"), "", ".git/info/exclude")
+		if err != nil {
+			return nil, err
+		}
+		s.exclude = &IgnoreMatcher{rules: rules}
+	}
+	if !config.NoGlobalExcludes {
+		if excludesFile := GlobalExcludesFile(repo); excludesFile != "" {
+			rules, err := LoadIgnoreFile(excludesFile, "", excludesFile)
+			if err != nil {
+				return nil, err
+			}
+			s.global = &IgnoreMatcher{rules: rules}
+		}
+	}
+	return s, nil
+}
+
+// newPatternStack creates a stack holding only the given patterns
+func newPatternStack(patterns []string) *IgnoreStack {
+	return &IgnoreStack{omit: NewIgnoreMatcher(patterns, "")}
+}
+
+// Match reports whether a path relative to the processed directory is ignored, along with the deciding rule (nil if none matched)
+func (s *IgnoreStack) Match(p string, isDir bool) (bool, *IgnoreRule) {
+	return matchWithParents(p, isDir, s.find)
+}
+
+// HasIncludes reports whether an include list narrows the selection
+func (s *IgnoreStack) HasIncludes() bool {
+	return s.includes != nil
+}
+
+// Includes reports whether a file relative to the processed directory passes the include list
+func (s *IgnoreStack) Includes(p string) bool {
+	if s.includes == nil {
+		return true
+	}
+	included, _ := s.includes.Match(p, false)
+	return included
+}
+
+// find returns the highest-precedence rule matching a single path, or nil. The sensitive defaults are the
+// lowest layer, but only omit patterns and .contextifyignore files can re-include what they leave out:
+// negations in git's own files do not, the same as when files are listed with --git-tracked.
+func (s *IgnoreStack) find(p string, isDir bool) *IgnoreRule {
+	if rule := s.omit.find(p, isDir); rule != nil {
+		return rule
+	}
+	rule := s.findRepo(p, isDir)
+	if rule != nil && path.Base(rule.Source) == ContextifyIgnoreFile {
+		return rule
+	}
+	if sensitive := s.sensitive.find(p, isDir); sensitive != nil && (rule == nil || rule.Negate && !sensitive.Negate) {
+		return sensitive
+	}
+	return rule
+}
+
+// findRepo returns the highest-precedence rule from the per-directory ignore files, .git/info/exclude and
+// the global excludes file, or nil
+func (s *IgnoreStack) findRepo(p string, isDir bool) *IgnoreRule {
+	full := p
+	if s.prefix != "" {
+		full = s.prefix + "/" + p
+	}
+	if len(s.perDir) > 0 {
+		for dir := path.Dir(full); ; dir = path.Dir(dir) {
+			if rule := s.dirMatcher(dir).find(full, isDir); rule != nil {
+				return rule
+			}
+			if dir == "." {
+				break
+			}
+		}
+	}
+	if rule := s.exclude.find(full, isDir); rule != nil {
+		return rule
+	}
+	return s.global.find(full, isDir)
+}
+
+// dirMatcher lazily loads the per-directory ignore files of a slash-separated directory relative to the repository root
+func (s *IgnoreStack) dirMatcher(dir string) *IgnoreMatcher {
+	if m, ok := s.dirs[dir]; ok {
+		return m
+	}
+	base := dir
+	if base == "." {
+		base = ""
+	}
+	m := &IgnoreMatcher{}
+	for _, name := range s.perDir {
+		if name == GitignoreFile && !s.nested && base != s.prefix {
+			continue
+		}
+		source := path.Join(base, name)
+		rules, err := LoadIgnoreFile(filepath.Join(s.repoRoot, filepath.FromSlash(source)), base, source)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+			continue
+		}
+		m.rules = append(m.rules, rules...)
+	}
+	s.dirs[dir] = m
+	return m
+}
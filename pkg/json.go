@@ -0,0 +1,132 @@
+package contextify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// jsonFormatter writes one record per header, file, skipped file and section, either as a JSON
+// array or, when lines is set, as JSON Lines
+type jsonFormatter struct {
+	lines    bool
+	preamble Preamble
+	records  int
+}
+
+// jsonHeader is the first record, describing the prompt and the tree
+type jsonHeader struct {
+	Type      string   `json:"type"`
+	Preprompt string   `json:"preprompt"` // With the request already substituted
+	Request   string   `json:"request,omitempty"`
+	Tree      []string `json:"tree,omitempty"`
+	Part      int      `json:"part,omitempty"`
+	Parts     int      `json:"parts,omitempty"`
+}
+
+// jsonFile is the record for a file or, when split across parts, a range of its lines
+type jsonFile struct {
+	Type      string `json:"type"`
+	Path      string `json:"path"`
+	Size      int    `json:"size"`
+	Mode      string `json:"mode"`
+	Language  string `json:"language,omitempty"`
+	SHA256    string `json:"sha256"`
+	Tokens    int    `json:"tokens"`
+	FirstLine int    `json:"first_line,omitempty"`
+	LastLine  int    `json:"last_line,omitempty"`
+	Content   string `json:"content"`
+}
+
+// jsonSkipped is the record for a selected file whose content was left out
+type jsonSkipped struct {
+	Type   string `json:"type"`
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+// jsonSection is the record for a trailing section
+type jsonSection struct {
+	Type    string `json:"type"`
+	Title   string `json:"title"`
+	Content string `json:"content"`
+}
+
+func (j *jsonFormatter) BeginDocument(w io.Writer) error {
+	if j.lines {
+		return nil
+	}
+	_, err := io.WriteString(w, "[")
+	return err
+}
+
+func (j *jsonFormatter) WritePreamble(w io.Writer, p Preamble) error {
+	// The header also carries the tree, so it is written once the tree is known
+	j.preamble = p
+	return nil
+}
+
+func (j *jsonFormatter) WriteTree(w io.Writer, lines []string) error {
+	return j.writeRecord(w, jsonHeader{
+		Type:      "header",
+		Preprompt: j.preamble.Preprompt,
+		Request:   j.preamble.Request,
+		Tree:      lines,
+		Part:      j.preamble.Part,
+		Parts:     j.preamble.Parts,
+	})
+}
+
+func (j *jsonFormatter) WriteFile(w io.Writer, file File) error {
+	return j.writeRecord(w, jsonFile{
+		Type:      "file",
+		Path:      file.Path,
+		Size:      file.Size,
+		Mode:      fmt.Sprintf("%04o", file.Mode.Perm()),
+		Language:  file.Language,
+		SHA256:    file.SHA256,
+		Tokens:    file.Tokens,
+		FirstLine: file.FirstLine,
+		LastLine:  file.LastLine,
+		Content:   string(file.Content),
+	})
+}
+
+func (j *jsonFormatter) WriteSkipped(w io.Writer, file FileStats) error {
+	return j.writeRecord(w, jsonSkipped{Type: "skipped", Path: file.Path, Reason: file.Skipped})
+}
+
+func (j *jsonFormatter) WriteSection(w io.Writer, s Section) error {
+	return j.writeRecord(w, jsonSection{Type: "section", Title: s.Title, Content: s.Body})
+}
+
+func (j *jsonFormatter) EndDocument(w io.Writer) error {
+	if j.lines {
+		return nil
+	}
+	_, err := io.WriteString(w, "\n]\n")
+	return err
+}
+
+// writeRecord writes a record on its own line, separated by commas inside a JSON array
+func (j *jsonFormatter) writeRecord(w io.Writer, record interface{}) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(record); err != nil {
+		return err
+	}
+	data := bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+	switch {
+	case j.lines:
+		data = append(data, '\n')
+	case j.records > 0:
+		data = append([]byte(",\n"), data...)
+	default:
+		data = append([]byte("\n"), data...)
+	}
+	j.records++
+	_, err := w.Write(data)
+	return err
+}
@@ -0,0 +1,177 @@
+package contextify
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Pack policies accepted in Config.PackPolicy
+const (
+	PackPriority = "priority"
+	PackSmallest = "smallest"
+	PackRecent   = "recent"
+	PackRequest  = "request"
+)
+
+// SkipTokenLimit is the skip reason for files dropped by packing
+const SkipTokenLimit = "token limit"
+
+// packFiles keeps the highest-priority files that fit within config.TokenLimit alongside overhead tokens
+// and the trailer listing what was dropped; kept files retain their original order
+func packFiles(config Config, files []sourceFile, overhead int, tokenizer Tokenizer, newFormatter func() Formatter) ([]sourceFile, []sourceFile, error) {
+	order, err := packOrder(config, files)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	kept := make([]bool, len(files))
+	used := overhead
+	var droppedIdx []int
+	for _, i := range order {
+		if files[i].stats.Skipped != "" {
+			kept[i] = true
+			continue
+		}
+		if used+files[i].stats.Tokens <= config.TokenLimit {
+			kept[i] = true
+			used += files[i].stats.Tokens
+		} else {
+			droppedIdx = append(droppedIdx, i)
+		}
+	}
+
+	// Make room for the trailer by giving up the lowest-priority files
+	dropped := func() []sourceFile {
+		var result []sourceFile
+		for _, i := range droppedIdx {
+			file := files[i]
+			file.stats.Skipped = SkipTokenLimit
+			result = append(result, file)
+		}
+		return result
+	}
+	for next := len(order) - 1; len(droppedIdx) > 0 && next >= 0; next-- {
+		trailer := renderItem(newFormatter, sectionItem(omittedTrailer(config, dropped())))
+		if used+tokenizer.CountTokens(trailer) <= config.TokenLimit {
+			break
+		}
+		i := order[next]
+		if kept[i] && files[i].stats.Skipped == "" {
+			kept[i] = false
+			used -= files[i].stats.Tokens
+			droppedIdx = append(droppedIdx, i)
+		}
+	}
+
+	var keptFiles []sourceFile
+	for i, file := range files {
+		if kept[i] {
+			keptFiles = append(keptFiles, file)
+		}
+	}
+	return keptFiles, dropped(), nil
+}
+
+// packOrder returns file indexes from highest to lowest packing priority
+func packOrder(config Config, files []sourceFile) ([]int, error) {
+	var less func(a, b sourceFile) bool
+	switch config.PackPolicy {
+	case "", PackPriority:
+		less = func(a, b sourceFile) bool { return false }
+	case PackSmallest:
+		less = func(a, b sourceFile) bool { return a.stats.Tokens < b.stats.Tokens }
+	case PackRecent:
+		less = func(a, b sourceFile) bool { return a.modTime.After(b.modTime) }
+	case PackRequest:
+		distances := requestDistances(config.Request, files)
+		less = func(a, b sourceFile) bool { return distances[a.stats.Path] < distances[b.stats.Path] }
+	default:
+		return nil, fmt.Errorf("unknown pack policy %q (expected %s, %s, %s or %s)", config.PackPolicy, PackPriority, PackSmallest, PackRecent, PackRequest)
+	}
+
+	// Priority patterns come first under every policy
+	groups := make([]int, len(files))
+	matchers := make([]*IgnoreMatcher, len(config.Priority))
+	for i, pattern := range config.Priority {
+		matchers[i] = NewIgnoreMatcher([]string{pattern}, "priority")
+	}
+	for i, file := range files {
+		groups[i] = len(matchers)
+		for j, m := range matchers {
+			if matched, _ := m.Match(file.stats.Path, false); matched {
+				groups[i] = j
+				break
+			}
+		}
+	}
+
+	order := make([]int, len(files))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := order[i], order[j]
+		if groups[a] != groups[b] {
+			return groups[a] < groups[b]
+		}
+		return less(files[a], files[b])
+	})
+	return order, nil
+}
+
+// requestDistances measures how far each file is in the directory tree from the nearest file named in the request
+func requestDistances(request string, files []sourceFile) map[string]int {
+	words := map[string]bool{}
+	for _, word := range strings.FieldsFunc(request, func(r rune) bool {
+		return !(r == '.' || r == '/' || r == '\\' || r == '_' || r == '-' ||
+			(r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9'))
+	}) {
+		words[strings.Trim(filepath.ToSlash(word), "./")] = true
+	}
+
+	var named []string
+	for _, file := range files {
+		p := filepath.ToSlash(file.stats.Path)
+		if words[p] || words[filepath.Base(p)] {
+			named = append(named, p)
+		}
+	}
+
+	distances := map[string]int{}
+	for _, file := range files {
+		p := filepath.ToSlash(file.stats.Path)
+		best := 0
+		for i, n := range named {
+			if d := treeDistance(p, n); i == 0 || d < best {
+				best = d
+			}
+		}
+		distances[file.stats.Path] = best
+	}
+	return distances
+}
+
+// treeDistance counts the directory steps between two slash-separated file paths
+func treeDistance(a, b string) int {
+	if a == b {
+		return 0
+	}
+	aParts := strings.Split(a, "/")
+	bParts := strings.Split(b, "/")
+	common := 0
+	for common < len(aParts)-1 && common < len(bParts)-1 && aParts[common] == bParts[common] {
+		common++
+	}
+	return (len(aParts) - 1 - common) + (len(bParts) - 1 - common) + 1
+}
+
+// omittedTrailer lists files dropped by packing so the model knows the context is partial
+func omittedTrailer(config Config, dropped []sourceFile) Section {
+	var b strings.Builder
+	for _, file := range dropped {
+		fmt.Fprintf(&b, "- %s (~%d tokens)\n", file.stats.Path, file.stats.Tokens)
+	}
+	return Section{Title: fmt.Sprintf("Omitted files (token limit of %d reached)", config.TokenLimit), Body: b.String()}
+}
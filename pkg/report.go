@@ -0,0 +1,202 @@
+package contextify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+)
+
+// Reasons a selected file was left out of the output
+const (
+	SkipBinary     = "binary"
+	SkipUnreadable = "unreadable"
+)
+
+// Report formats accepted by WriteReport
+const (
+	ReportText = "text"
+	ReportJSON = "json"
+)
+
+// FileStats describes one selected file and what it contributed to the output
+type FileStats struct {
+	Path        string `json:"path"`
+	Bytes       int    `json:"bytes"`
+	Lines       int    `json:"lines"`
+	Tokens      int    `json:"tokens"`
+	SavedTokens int    `json:"saved_tokens,omitempty"` // Tokens removed by content transforms such as skeleton mode
+	Skipped     string `json:"skipped,omitempty"`      // Reason the file was left out, empty if included
+}
+
+// DirectoryStats rolls up the files below a directory, recursively
+type DirectoryStats struct {
+	Path   string `json:"path"`
+	Files  int    `json:"files"`
+	Bytes  int    `json:"bytes"`
+	Lines  int    `json:"lines"`
+	Tokens int    `json:"tokens"`
+}
+
+// Stats summarizes a ProcessDirectory run
+type Stats struct {
+	Tokenizer   string          `json:"tokenizer"`
+	TotalChars  int             `json:"total_chars"`
+	TotalTokens int             `json:"total_tokens"` // Tokens across the whole output, including preprompt and tree
+	Files       []FileStats     `json:"files"`
+	Secrets     []SecretFinding `json:"secrets,omitempty"` // Possible secrets found, redacted or skipped
+}
+
+// SavedTokens totals the tokens removed from included files by content transforms
+func (s *Stats) SavedTokens() int {
+	saved := 0
+	for _, f := range s.Files {
+		if f.Skipped == "" {
+			saved += f.SavedTokens
+		}
+	}
+	return saved
+}
+
+// Directories aggregates included files into every directory containing them, sorted by tokens descending
+func (s *Stats) Directories() []DirectoryStats {
+	byPath := map[string]*DirectoryStats{}
+	for _, f := range s.Files {
+		if f.Skipped != "" {
+			continue
+		}
+		for dir := filepath.Dir(f.Path); ; dir = filepath.Dir(dir) {
+			d, ok := byPath[dir]
+			if !ok {
+				d = &DirectoryStats{Path: dir}
+				byPath[dir] = d
+			}
+			d.Files++
+			d.Bytes += f.Bytes
+			d.Lines += f.Lines
+			d.Tokens += f.Tokens
+			if dir == "." || dir == filepath.Dir(dir) {
+				break
+			}
+		}
+	}
+	dirs := make([]DirectoryStats, 0, len(byPath))
+	for _, d := range byPath {
+		dirs = append(dirs, *d)
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		if dirs[i].Tokens != dirs[j].Tokens {
+			return dirs[i].Tokens > dirs[j].Tokens
+		}
+		return dirs[i].Path < dirs[j].Path
+	})
+	return dirs
+}
+
+// WriteReport writes a per-file and per-directory breakdown of stats in the given format
+func WriteReport(w io.Writer, stats *Stats, format string) error {
+	files := append([]FileStats(nil), stats.Files...)
+	sort.SliceStable(files, func(i, j int) bool {
+		if files[i].Tokens != files[j].Tokens {
+			return files[i].Tokens > files[j].Tokens
+		}
+		return files[i].Path < files[j].Path
+	})
+
+	switch format {
+	case "", ReportText:
+		return writeTextReport(w, stats, files)
+	case ReportJSON:
+		report := struct {
+			*Stats
+			Files       []FileStats      `json:"files"`
+			Directories []DirectoryStats `json:"directories"`
+		}{stats, files, stats.Directories()}
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return fmt.Errorf("error encoding report: %v", err)
+		}
+		_, err = w.Write(append(data, '\n'))
+		return err
+	default:
+		return fmt.Errorf("unknown report format %q (expected %s or %s)", format, ReportText, ReportJSON)
+	}
+}
+
+// writeTextReport writes the report as aligned tables
+func writeTextReport(w io.Writer, stats *Stats, files []FileStats) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "Tokens\tBytes\tLines\t  File\n")
+	var skipped []FileStats
+	for _, f := range files {
+		if f.Skipped != "" {
+			skipped = append(skipped, f)
+			continue
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%d\t  %s\n", f.Tokens, f.Bytes, f.Lines, f.Path)
+	}
+	fmt.Fprintf(tw, "\nTokens\tBytes\tLines\tFiles\t  Directory\n")
+	for _, d := range stats.Directories() {
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t  %s\n", d.Tokens, d.Bytes, d.Lines, d.Files, d.Path)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if len(skipped) > 0 {
+		fmt.Fprintf(w, "\nSkipped:\n")
+		for _, f := range skipped {
+			fmt.Fprintf(w, "  %s (%s)\n", f.Path, f.Skipped)
+		}
+	}
+	if len(stats.Secrets) > 0 {
+		fmt.Fprintf(w, "\nPossible secrets:\n")
+		for _, f := range stats.Secrets {
+			fmt.Fprintf(w, "  %s:%d: %s\n", f.Path, f.Line, f.Kind)
+		}
+	}
+	if saved := stats.SavedTokens(); saved > 0 {
+		fmt.Fprintf(w, "\nSaved by transforms: %d tokens\n", saved)
+	}
+	_, err := fmt.Fprintf(w, "\nTotal: %d characters, %d tokens (%s)\n", stats.TotalChars, stats.TotalTokens, stats.Tokenizer)
+	return err
+}
+
+// WriteSelection lists the selected files in output order with their sizes and tokens, followed by the
+// totals against tokenLimit, for runs that write nothing
+func WriteSelection(w io.Writer, stats *Stats, tokenLimit int) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "Tokens\tBytes\t  File\n")
+	included := 0
+	for _, f := range stats.Files {
+		if f.Skipped != "" {
+			fmt.Fprintf(tw, "-\t%d\t  %s (skipped: %s)\n", f.Bytes, f.Path, f.Skipped)
+			continue
+		}
+		included++
+		fmt.Fprintf(tw, "%d\t%d\t  %s\n", f.Tokens, f.Bytes, f.Path)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "\n%d files selected, %d skipped\n", included, len(stats.Files)-included)
+	fmt.Fprintf(w, "Total: %d characters (~%d tokens, %s)\n", stats.TotalChars, stats.TotalTokens, stats.Tokenizer)
+	difference := tokenLimit - stats.TotalTokens
+	if difference >= 0 {
+		_, err := fmt.Fprintf(w, "Token limit: %d (fits, %d tokens to spare)\n", tokenLimit, difference)
+		return err
+	}
+	_, err := fmt.Fprintf(w, "Token limit: %d (exceeds by %d tokens)\n", tokenLimit, -difference)
+	return err
+}
+
+// countLines counts lines in content, including a final line without a trailing newline
+func countLines(content []byte) int {
+	lines := bytes.Count(content, []byte("\n"))
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		lines++
+	}
+	return lines
+}
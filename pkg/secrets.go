@@ -0,0 +1,169 @@
+package contextify
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Actions taken when a file contains possible secrets, accepted in Config.Secrets
+const (
+	SecretsRedact = "redact"
+	SecretsSkip   = "skip"
+	SecretsAbort  = "abort"
+)
+
+// SkipSecret is the skip reason for files left out because they contain possible secrets
+const SkipSecret = "secret"
+
+// DiffSecretPath is the path reported for possible secrets found in the diff section
+const DiffSecretPath = "(diff)"
+
+// SecretFinding is a possible credential found in a selected file
+type SecretFinding struct {
+	Path  string `json:"path"`
+	Line  int    `json:"line"`
+	Kind  string `json:"kind"`
+	start int    // Byte range of the secret in the file
+	end   int
+}
+
+// secretPattern detects one kind of credential; when the expression has groups, the first non-empty
+// group is the secret itself and the rest of the match is context
+type secretPattern struct {
+	kind  string
+	re    *regexp.Regexp
+	check func(value string) bool // Extra test on the secret, nil to accept every match
+}
+
+var secretPatterns = []secretPattern{
+	{kind: "private-key", re: regexp.MustCompile(`-----BEGIN[A-Z ]* PRIVATE KEY(?: BLOCK)?-----(?s:.*?)-----END[A-Z ]* PRIVATE KEY(?: BLOCK)?-----`)},
+	{kind: "aws-access-key-id", re: regexp.MustCompile(`\b((?:AKIA|ASIA|ABIA|ACCA)[0-9A-Z]{16})\b`)},
+	{kind: "aws-secret-access-key", re: regexp.MustCompile(`(?i)aws_?secret_?access_?key["']?\s*(?::=|[:=])\s*["']?([A-Za-z0-9/+=]{40})\b`)},
+	{kind: "jwt", re: regexp.MustCompile(`\b(eyJ[A-Za-z0-9_-]{10,}\.eyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,})`)},
+	{
+		kind: "high-entropy-assignment",
+		re: regexp.MustCompile(`(?im)[\w.-]*(?:secret|token|passw(?:or)?d|pwd|api[_-]?key|access[_-]?key|private[_-]?key|auth[_-]?key|credential)s?[\w.-]*["']?[ \t]*(?::=|[:=])[ \t]*` +
+			`(?:"([^"\s]{16,})"|'([^'\s]{16,})'|([A-Za-z0-9_\-+/=.~]{16,})[ \t]*(?:#.*)?$)`),
+		// Identifiers such as config.DefaultTokenLimit are code, not credentials
+		check: func(value string) bool {
+			return strings.ContainsAny(value, "0123456789") && shannonEntropy(value) >= 3.5
+		},
+	},
+}
+
+// envLine matches a KEY=value assignment in a .env file, capturing the value
+var envLine = regexp.MustCompile(`(?m)^[ \t]*(?:export[ \t]+)?[A-Za-z_][A-Za-z0-9_.]*[ \t]*=[ \t]*(\S.*?)[ \t\r]*$`)
+
+// isEnvFile reports whether path looks like a dotenv file, such as .env, .env.local or prod.env
+func isEnvFile(path string) bool {
+	base := filepath.Base(path)
+	return base == ".env" || strings.HasPrefix(base, ".env.") || strings.HasSuffix(base, ".env")
+}
+
+// ScanSecrets looks for credentials in content: AWS keys, private key blocks, JWTs, high-entropy values
+// assigned to secret-sounding names and every value in .env files. Findings are sorted by position
+// and never overlap.
+func ScanSecrets(path string, content []byte) []SecretFinding {
+	text := string(content)
+	var findings []SecretFinding
+	add := func(kind string, start, end int) {
+		findings = append(findings, SecretFinding{Path: path, Kind: kind, start: start, end: end})
+	}
+	for _, pattern := range secretPatterns {
+		for _, m := range pattern.re.FindAllStringSubmatchIndex(text, -1) {
+			start, end := m[0], m[1]
+			for g := 2; g < len(m); g += 2 {
+				if m[g] >= 0 {
+					start, end = m[g], m[g+1]
+					break
+				}
+			}
+			if pattern.check == nil || pattern.check(text[start:end]) {
+				add(pattern.kind, start, end)
+			}
+		}
+	}
+	if isEnvFile(path) {
+		for _, m := range envLine.FindAllStringSubmatchIndex(text, -1) {
+			add("env-value", m[2], m[3])
+		}
+	}
+
+	// Keep the earliest, then longest, of overlapping findings
+	sort.SliceStable(findings, func(i, j int) bool {
+		if findings[i].start != findings[j].start {
+			return findings[i].start < findings[j].start
+		}
+		return findings[i].end > findings[j].end
+	})
+	var merged []SecretFinding
+	for _, f := range findings {
+		if len(merged) > 0 && f.start < merged[len(merged)-1].end {
+			continue
+		}
+		f.Line = strings.Count(text[:f.start], "\n") + 1
+		merged = append(merged, f)
+	}
+	return merged
+}
+
+// redactSecrets replaces each finding in content with a placeholder naming its kind
+func redactSecrets(content []byte, findings []SecretFinding) []byte {
+	var b strings.Builder
+	last := 0
+	for _, f := range findings {
+		b.Write(content[last:f.start])
+		fmt.Fprintf(&b, "[REDACTED:%s]", f.Kind)
+		last = f.end
+	}
+	b.Write(content[last:])
+	return []byte(b.String())
+}
+
+// shannonEntropy returns the entropy of s in bits per character
+func shannonEntropy(s string) float64 {
+	counts := map[rune]int{}
+	total := 0
+	for _, r := range s {
+		counts[r]++
+		total++
+	}
+	entropy := 0.0
+	for _, n := range counts {
+		p := float64(n) / float64(total)
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// secretsAction returns the configured action for files with possible secrets
+func secretsAction(config Config) (string, error) {
+	switch config.Secrets {
+	case "", SecretsRedact:
+		return SecretsRedact, nil
+	case SecretsSkip, SecretsAbort:
+		return config.Secrets, nil
+	default:
+		return "", fmt.Errorf("unknown secrets action %q (expected %s, %s or %s)", config.Secrets, SecretsRedact, SecretsSkip, SecretsAbort)
+	}
+}
+
+// writeSecretsSummary lists findings along with what was done about them
+func writeSecretsSummary(w io.Writer, action string, findings []SecretFinding) {
+	switch action {
+	case SecretsRedact:
+		fmt.Fprintf(w, "Redacted %d possible secrets (use --no-redact to keep them):\n", len(findings))
+	case SecretsSkip:
+		fmt.Fprintf(w, "Skipped files with %d possible secrets (use --no-redact to include them):\n", len(findings))
+	default:
+		fmt.Fprintf(w, "Found %d possible secrets (use --no-redact to include them):\n", len(findings))
+	}
+	for _, f := range findings {
+		fmt.Fprintf(w, "  %s:%d: %s\n", f.Path, f.Line, f.Kind)
+	}
+}
@@ -0,0 +1,163 @@
+package contextify
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// partChunk is a piece of the document body that is kept whole unless it cannot fit in any part
+type partChunk struct {
+	item  docItem
+	split func(budget int) []docItem // Breaks the chunk at line boundaries into pieces within budget
+}
+
+// PartPath returns the path of part n for an output path, e.g. output.part1.txt for output.txt
+func PartPath(output string, n int) string {
+	return PartPathPattern(output, fmt.Sprint(n))
+}
+
+// PartPathPattern returns the path of a part with an arbitrary label in place of its number
+func PartPathPattern(output, label string) string {
+	ext := filepath.Ext(output)
+	return strings.TrimSuffix(output, ext) + ".part" + label + ext
+}
+
+// ProcessDirectoryParts processes the directory like ProcessDirectory, but when the output exceeds
+// config.TokenLimit it is split into parts that each fit. Every part repeats the preprompt and a
+// "Part N of M" marker, and only the first part carries the directory tree. A file is only broken
+// across parts, at line boundaries, when it does not fit in a part on its own.
+func ProcessDirectoryParts(config Config) ([][]byte, *Stats, error) {
+	tokenizer, err := NewTokenizer(config.Tokenizer)
+	if err != nil {
+		return nil, nil, err
+	}
+	doc, err := buildDocument(config, tokenizer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var chunks []partChunk
+	for _, file := range doc.files {
+		if file.stats.Skipped != "" {
+			chunks = append(chunks, partChunk{item: skippedItem(file.stats)})
+			continue
+		}
+		out := file.output()
+		chunks = append(chunks, partChunk{
+			item: fileItem(out),
+			split: func(budget int) []docItem {
+				return splitLines(string(out.Content), budget, tokenizer, doc.newFormatter, func(first, last int, body string) docItem {
+					piece := out
+					piece.Content, piece.FirstLine, piece.LastLine = []byte(body), first, last
+					piece.Tokens = tokenizer.CountTokens(body)
+					return fileItem(piece)
+				})
+			},
+		})
+	}
+	for _, s := range doc.sections {
+		s := s
+		chunks = append(chunks, partChunk{
+			item: sectionItem(s),
+			split: func(budget int) []docItem {
+				return splitLines(s.Body, budget, tokenizer, doc.newFormatter, func(first, last int, body string) docItem {
+					piece := s
+					piece.Body = body
+					return sectionItem(piece)
+				})
+			},
+		})
+	}
+
+	var items []docItem
+	for _, chunk := range chunks {
+		items = append(items, chunk.item)
+	}
+	stats := &Stats{Tokenizer: tokenizer.Name(), Files: doc.fileStats(), Secrets: doc.secrets}
+	whole := doc.render(doc.preamble, doc.tree, items)
+	if config.TokenLimit <= 0 || tokenizer.CountTokens(whole) <= config.TokenLimit {
+		stats.TotalChars = len(whole)
+		stats.TotalTokens = tokenizer.CountTokens(whole)
+		return [][]byte{[]byte(whole)}, stats, nil
+	}
+
+	// Reserve room for the repeated preamble with the widest marker
+	marked := doc.preamble
+	marked.Part, marked.Parts = 999, 999
+	reserve := tokenizer.CountTokens(doc.render(marked, nil, nil))
+	budget := config.TokenLimit - reserve
+	firstBudget := config.TokenLimit - tokenizer.CountTokens(doc.render(marked, doc.tree, nil))
+
+	parts := [][]docItem{{}}
+	used := 0
+	for _, chunk := range chunks {
+		partBudget := budget
+		if len(parts) == 1 {
+			partBudget = firstBudget
+		}
+		tokens := tokenizer.CountTokens(renderItem(doc.newFormatter, chunk.item))
+		if used+tokens <= partBudget {
+			parts[len(parts)-1] = append(parts[len(parts)-1], chunk.item)
+			used += tokens
+			continue
+		}
+		if len(parts[len(parts)-1]) > 0 || partBudget < budget {
+			parts = append(parts, []docItem{})
+			used = 0
+		}
+		if tokens <= budget || chunk.split == nil {
+			parts[len(parts)-1] = append(parts[len(parts)-1], chunk.item)
+			used = tokens
+			continue
+		}
+
+		// Too large for any part on its own
+		pieces := chunk.split(budget)
+		for i, piece := range pieces {
+			if i > 0 {
+				parts = append(parts, []docItem{})
+			}
+			parts[len(parts)-1] = append(parts[len(parts)-1], piece)
+			used = tokenizer.CountTokens(renderItem(doc.newFormatter, piece))
+		}
+	}
+
+	var rendered [][]byte
+	for i, part := range parts {
+		p := doc.preamble
+		p.Part, p.Parts = i+1, len(parts)
+		var tree []string
+		if i == 0 {
+			tree = doc.tree
+		}
+		text := doc.render(p, tree, part)
+		rendered = append(rendered, []byte(text))
+		stats.TotalChars += len(text)
+		stats.TotalTokens += tokenizer.CountTokens(text)
+	}
+	return rendered, stats, nil
+}
+
+// splitLines breaks text into line-aligned pieces framed by frame, each estimated to fit within budget;
+// a single line longer than the budget becomes a piece of its own
+func splitLines(text string, budget int, tokenizer Tokenizer, newFormatter func() Formatter, frame func(first, last int, body string) docItem) []docItem {
+	lines := strings.SplitAfter(text, "\n")
+	if len(lines) > 1 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	overhead := tokenizer.CountTokens(renderItem(newFormatter, frame(len(lines), len(lines), "")))
+
+	var pieces []docItem
+	start, used := 0, 0
+	for i, line := range lines {
+		// Per-line counts are rounded up so the sum never underestimates the piece
+		tokens := tokenizer.CountTokens(line) + 1
+		if i > start && overhead+used+tokens > budget {
+			pieces = append(pieces, frame(start+1, i, strings.Join(lines[start:i], "")))
+			start, used = i, 0
+		}
+		used += tokens
+	}
+	return append(pieces, frame(start+1, len(lines), strings.Join(lines[start:], "")))
+}
@@ -0,0 +1,73 @@
+package contextify
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+// Tokenizer names accepted in Config.Tokenizer
+const (
+	TokenizerHeuristic = "heuristic"
+	TokenizerCL100K    = "cl100k_base"
+	TokenizerO200K     = "o200k_base"
+)
+
+// Tokenizer counts the tokens a model would see for a piece of text
+type Tokenizer interface {
+	Name() string
+	CountTokens(text string) int
+}
+
+// heuristicTokenizer estimates tokens from the character count
+type heuristicTokenizer struct{}
+
+func (heuristicTokenizer) Name() string { return TokenizerHeuristic }
+
+func (heuristicTokenizer) CountTokens(text string) int { return len(text) / CharPerToken }
+
+// bpeTokenizer counts tokens with a byte pair encoding vocabulary bundled in the binary
+type bpeTokenizer struct {
+	name     string
+	encoding *tiktoken.Tiktoken
+}
+
+func (t *bpeTokenizer) Name() string { return t.name }
+
+func (t *bpeTokenizer) CountTokens(text string) int { return len(t.encoding.EncodeOrdinary(text)) }
+
+var (
+	loaderOnce    sync.Once
+	encodingsLock sync.Mutex
+	encodings     = map[string]*bpeTokenizer{}
+)
+
+// NewTokenizer returns the tokenizer with the given name; an empty name selects the character heuristic
+func NewTokenizer(name string) (Tokenizer, error) {
+	switch name {
+	case "", TokenizerHeuristic:
+		return heuristicTokenizer{}, nil
+	case TokenizerCL100K, TokenizerO200K:
+	default:
+		return nil, fmt.Errorf("unknown tokenizer %q (expected %s, %s or %s)", name, TokenizerHeuristic, TokenizerCL100K, TokenizerO200K)
+	}
+
+	// Vocabularies are read from embedded assets rather than downloaded
+	loaderOnce.Do(func() {
+		tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+	})
+	encodingsLock.Lock()
+	defer encodingsLock.Unlock()
+	if t, ok := encodings[name]; ok {
+		return t, nil
+	}
+	encoding, err := tiktoken.GetEncoding(name)
+	if err != nil {
+		return nil, fmt.Errorf("error loading tokenizer %s: %v", name, err)
+	}
+	t := &bpeTokenizer{name: name, encoding: encoding}
+	encodings[name] = t
+	return t, nil
+}
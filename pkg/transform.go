@@ -0,0 +1,430 @@
+package contextify
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// DefaultLineNumberSeparator separates line numbers from file contents
+const DefaultLineNumberSeparator = " | "
+
+// transformContent applies the configured content transforms between reading a file and writing it:
+// Go skeletons, then comment stripping, then line numbering. It returns the transformed content and
+// the tokens removed before line numbers were added.
+func transformContent(config Config, path, language string, content []byte, tokenizer Tokenizer) ([]byte, int) {
+	original := content
+	if config.Skeleton && language == "go" && strings.EqualFold(filepath.Ext(path), ".go") {
+		if skeleton, err := goSkeleton(content); err == nil {
+			content = skeleton
+		} else {
+			fmt.Fprintf(os.Stderr, "Keeping full content of %s: %v\n", path, err)
+		}
+	}
+	if config.StripComments {
+		if syntax, ok := commentSyntaxes[language]; ok {
+			content = stripComments(content, syntax)
+		}
+	}
+	saved := 0
+	if len(content) != len(original) {
+		saved = tokenizer.CountTokens(string(original)) - tokenizer.CountTokens(string(content))
+	}
+	if config.LineNumbers {
+		content = numberLines(content, config.LineNumberWidth, config.LineNumberSeparator)
+	}
+	return content, saved
+}
+
+// numberLines prefixes every line of content with its right-aligned number; the width grows to fit the
+// last line number when it is wider than width
+func numberLines(content []byte, width int, separator string) []byte {
+	if len(content) == 0 {
+		return content
+	}
+	if separator == "" {
+		separator = DefaultLineNumberSeparator
+	}
+	lines := bytes.SplitAfter(content, []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	if digits := len(fmt.Sprint(len(lines))); digits > width {
+		width = digits
+	}
+
+	var b bytes.Buffer
+	for i, line := range lines {
+		fmt.Fprintf(&b, "%*d%s", width, i+1, separator)
+		b.Write(line)
+	}
+	return b.Bytes()
+}
+
+// goSkeleton reduces Go source to its API surface: the package clause, imports, declarations and function
+// signatures with their doc comments, with function bodies and the comments inside them removed
+func goSkeleton(content []byte) ([]byte, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "", content, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	var bodies []*ast.BlockStmt
+	for _, decl := range file.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok && fn.Body != nil {
+			bodies = append(bodies, fn.Body)
+			fn.Body = nil
+		}
+	}
+	var comments []*ast.CommentGroup
+	for _, group := range file.Comments {
+		inBody := false
+		for _, body := range bodies {
+			if group.Pos() > body.Lbrace && group.End() <= body.Rbrace {
+				inBody = true
+				break
+			}
+		}
+		if !inBody {
+			comments = append(comments, group)
+		}
+	}
+	file.Comments = comments
+
+	var b bytes.Buffer
+	if err := format.Node(&b, fset, file); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// commentSyntax describes how comments and string literals are written in a language
+type commentSyntax struct {
+	line        []string // Line comment markers
+	blockStart  string   // Block comment delimiters, empty if the language has none
+	blockEnd    string
+	quotes      string   // Quote characters opening single-line string literals with backslash escapes
+	multiline   string   // Quote characters opening string literals that may span lines, with backslash escapes
+	raw         string   // Quote characters opening string literals that may span lines, without escapes
+	triple      string   // Quote characters opening triple-quoted strings that may span lines, as in Python or Java text blocks
+	rawDelim    bool     // R"delim(...)delim" raw strings, as in C++
+	wordStart   bool     // Line markers only start a comment at the beginning of a word, as in shell
+	heredoc     bool     // <<WORD opens a body running to a line holding WORD, kept verbatim, as in shell
+	blockScalar bool     // A line ending in | or > opens a block of more indented lines kept verbatim, as in YAML
+	keep        []string // Comment prefixes that carry meaning and are never stripped, such as build directives
+}
+
+var (
+	cFamilySyntax   = commentSyntax{line: []string{"//"}, blockStart: "/*", blockEnd: "*/", quotes: `"'`}
+	textBlockSyntax = commentSyntax{line: []string{"//"}, blockStart: "/*", blockEnd: "*/", quotes: `"'`, triple: `"`}
+	hashSyntax      = commentSyntax{line: []string{"#"}, quotes: `"'`, wordStart: true}
+	shellSyntax     = commentSyntax{line: []string{"#"}, quotes: `"'`, wordStart: true, heredoc: true}
+)
+
+// commentSyntaxes maps DetectLanguage tags to their comment syntax
+var commentSyntaxes = map[string]commentSyntax{
+	"go":         {line: []string{"//"}, blockStart: "/*", blockEnd: "*/", quotes: `"'`, raw: "`", keep: []string{"//go:", "//line ", "// +build"}},
+	"javascript": {line: []string{"//"}, blockStart: "/*", blockEnd: "*/", quotes: `"'`, multiline: "`"},
+	"typescript": {line: []string{"//"}, blockStart: "/*", blockEnd: "*/", quotes: `"'`, multiline: "`", keep: []string{"/// <reference"}},
+	"jsx":        {line: []string{"//"}, blockStart: "/*", blockEnd: "*/", quotes: `"'`, multiline: "`"},
+	"tsx":        {line: []string{"//"}, blockStart: "/*", blockEnd: "*/", quotes: `"'`, multiline: "`"},
+	"c":          cFamilySyntax,
+	"cpp":        {line: []string{"//"}, blockStart: "/*", blockEnd: "*/", quotes: `"'`, rawDelim: true},
+	"csharp":     textBlockSyntax,
+	"java":       textBlockSyntax,
+	"kotlin":     textBlockSyntax,
+	"scala":      textBlockSyntax,
+	"swift":      textBlockSyntax,
+	"dart":       cFamilySyntax,
+	"rust":       {line: []string{"//"}, blockStart: "/*", blockEnd: "*/", multiline: `"`}, // ' also starts lifetimes
+	"css":        {blockStart: "/*", blockEnd: "*/", quotes: `"'`},
+	"scss":       cFamilySyntax,
+	"php":        {line: []string{"//", "#"}, blockStart: "/*", blockEnd: "*/", quotes: `"'`},
+	"python":     {line: []string{"#"}, quotes: `"'`, triple: `"'`},
+	"bash":       shellSyntax,
+	"zsh":        shellSyntax,
+	"fish":       shellSyntax,
+	"yaml":       {line: []string{"#"}, quotes: `"'`, wordStart: true, blockScalar: true},
+}
+
+// stripComments removes comments outside string literals, drops lines left empty by the removal and
+// collapses runs of blank lines into one. A shebang on the first line is kept. When unsure whether text
+// is inside a string, the scanner errs on the side of keeping it.
+func stripComments(content []byte, syntax commentSyntax) []byte {
+	var out, line bytes.Buffer
+	stripped := false      // The current line lost a comment
+	lastBlank := true      // Drops leading blank lines and collapses runs of them
+	var heredocs []heredoc // Heredocs opened on the current line, whose bodies follow it
+	endLine := func() {
+		text := bytes.TrimRight(line.Bytes(), " \t\r")
+		blank := len(bytes.TrimSpace(text)) == 0
+		if !blank || (!stripped && !lastBlank) {
+			out.Write(text)
+			out.WriteByte('\n')
+			lastBlank = blank
+		}
+		line.Reset()
+		stripped = false
+	}
+
+	if bytes.HasPrefix(content, []byte("#!")) {
+		end := bytes.IndexByte(content, '\n')
+		if end < 0 {
+			return content
+		}
+		out.Write(content[:end+1])
+		content = content[end+1:]
+		lastBlank = false
+	}
+
+	for i := 0; i < len(content); {
+		c := content[i]
+		rest := content[i:]
+		switch {
+		case c == '\n':
+			text := line.String()
+			endLine()
+			i++
+			if syntax.blockScalar && blockScalarStart.MatchString(text) {
+				indent := len(text) - len(strings.TrimLeft(text, " "))
+				n := blockScalarBody(content[i:], indent)
+				out.Write(content[i : i+n])
+				i += n
+				if n > 0 {
+					lastBlank = false
+				}
+			}
+			for _, h := range heredocs {
+				n := heredocBody(content[i:], h)
+				out.Write(content[i : i+n])
+				i += n
+				lastBlank = false
+			}
+			heredocs = nil
+		case syntax.heredoc && bytes.HasPrefix(rest, []byte("<<")):
+			h, n := parseHeredoc(rest)
+			if n > 0 {
+				heredocs = append(heredocs, h)
+			} else {
+				n = 2
+				if bytes.HasPrefix(rest, []byte("<<<")) {
+					n = 3
+				}
+			}
+			line.Write(rest[:n])
+			i += n
+		case syntax.blockStart != "" && bytes.HasPrefix(rest, []byte(syntax.blockStart)):
+			end := bytes.Index(rest[len(syntax.blockStart):], []byte(syntax.blockEnd))
+			if end < 0 {
+				end = len(rest)
+			} else {
+				end += len(syntax.blockStart) + len(syntax.blockEnd)
+			}
+			stripped = true
+			// A comment spanning lines still separates what comes before and after it
+			if bytes.IndexByte(rest[:end], '\n') >= 0 {
+				endLine()
+				stripped = true
+			} else if line.Len() > 0 && !bytes.HasSuffix(line.Bytes(), []byte(" ")) {
+				line.WriteByte(' ')
+			}
+			i += end
+		case isLineComment(content, i, syntax):
+			end := bytes.IndexByte(rest, '\n')
+			if end < 0 {
+				end = len(rest)
+			}
+			stripped = true
+			i += end
+		case syntax.rawDelim && bytes.HasPrefix(rest, []byte(`R"`)):
+			end := rawStringEnd(rest)
+			line.Write(rest[:end])
+			i += end
+		case strings.IndexByte(syntax.triple, c) >= 0 && bytes.HasPrefix(rest, bytes.Repeat(rest[:1], 3)):
+			end := stringEnd(rest, rest[:3], true, true)
+			line.Write(rest[:end])
+			i += end
+		case strings.IndexByte(syntax.quotes, c) >= 0:
+			end := stringEnd(rest, rest[:1], true, false)
+			line.Write(rest[:end])
+			i += end
+		case strings.IndexByte(syntax.multiline, c) >= 0:
+			end := stringEnd(rest, rest[:1], true, true)
+			line.Write(rest[:end])
+			i += end
+		case strings.IndexByte(syntax.raw, c) >= 0:
+			end := stringEnd(rest, rest[:1], false, true)
+			line.Write(rest[:end])
+			i += end
+		default:
+			line.WriteByte(c)
+			i++
+		}
+	}
+	if line.Len() > 0 {
+		endLine()
+	}
+	result := bytes.TrimRight(out.Bytes(), "\n")
+	if len(result) > 0 && bytes.HasSuffix(content, []byte("\n")) {
+		result = append(result, '\n')
+	}
+	return result
+}
+
+// blockScalarStart matches a YAML line whose value is a literal or folded block scalar, such as "key: |" or "- >-"
+var blockScalarStart = regexp.MustCompile(`^\s*(?:.*:\s+|-\s+)?[|>][1-9+-]*\s*$`)
+
+// blockScalarBody returns the length of the block scalar body at the start of text: the lines indented deeper
+// than indent, with blank lines inside the body but not those after it
+func blockScalarBody(text []byte, indent int) int {
+	end := 0
+	for i := 0; i < len(text); {
+		next := len(text)
+		if n := bytes.IndexByte(text[i:], '\n'); n >= 0 {
+			next = i + n + 1
+		}
+		line := bytes.TrimRight(text[i:next], "\r\n")
+		if len(bytes.TrimSpace(line)) > 0 {
+			if len(line)-len(bytes.TrimLeft(line, " ")) <= indent {
+				break
+			}
+			end = next
+		}
+		i = next
+	}
+	return end
+}
+
+// rawStringEnd returns the length of the C++ raw string R"delim(...)delim" at the start of text, or of just
+// the R when it does not open one; an unterminated raw string runs to the end of text
+func rawStringEnd(text []byte) int {
+	open := bytes.IndexByte(text, '(')
+	if open < 0 || open > len(`R"`)+16 || bytes.ContainsAny(text[2:open], " \t\n\\)\"") {
+		return 1
+	}
+	closing := append([]byte(")"), text[2:open]...)
+	closing = append(closing, '"')
+	end := bytes.Index(text[open:], closing)
+	if end < 0 {
+		return len(text)
+	}
+	return open + end + len(closing)
+}
+
+// heredoc is a shell here-document waiting for its terminating line
+type heredoc struct {
+	word      string
+	stripTabs bool // <<- allows the terminator to be indented with tabs
+}
+
+// parseHeredoc reads a heredoc redirection such as <<EOF, <<-EOF or <<'EOF' at the start of text and
+// returns it with the length of the redirection, or a zero length if text does not start one
+func parseHeredoc(text []byte) (heredoc, int) {
+	if !bytes.HasPrefix(text, []byte("<<")) || bytes.HasPrefix(text, []byte("<<<")) {
+		return heredoc{}, 0
+	}
+	var h heredoc
+	i := 2
+	if i < len(text) && text[i] == '-' {
+		h.stripTabs = true
+		i++
+	}
+	for i < len(text) && (text[i] == ' ' || text[i] == '\t') {
+		i++
+	}
+	if i < len(text) && (text[i] == '\'' || text[i] == '"') {
+		end := bytes.IndexByte(text[i+1:], text[i])
+		if end <= 0 || bytes.IndexByte(text[i+1:i+1+end], '\n') >= 0 {
+			return heredoc{}, 0
+		}
+		h.word = string(text[i+1 : i+1+end])
+		return h, i + end + 2
+	}
+	if i < len(text) && text[i] == '\\' {
+		i++
+	}
+	start := i
+	for i < len(text) && isHeredocWordByte(text[i], i == start) {
+		i++
+	}
+	if i == start {
+		return heredoc{}, 0
+	}
+	h.word = string(text[start:i])
+	return h, i
+}
+
+// isHeredocWordByte reports whether c may appear in an unquoted heredoc terminator; a leading digit is
+// refused so that shifts such as $((1<<2)) are not taken for heredocs
+func isHeredocWordByte(c byte, first bool) bool {
+	switch {
+	case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c == '_':
+		return true
+	case c >= '0' && c <= '9', c == '-', c == '.':
+		return !first
+	}
+	return false
+}
+
+// heredocBody returns the length of the heredoc body at the start of text, including its terminating
+// line; an unterminated body runs to the end of text
+func heredocBody(text []byte, h heredoc) int {
+	for i := 0; i < len(text); {
+		end := bytes.IndexByte(text[i:], '\n')
+		next := len(text)
+		if end >= 0 {
+			next = i + end + 1
+		}
+		line := bytes.TrimRight(text[i:next], "\r\n")
+		if h.stripTabs {
+			line = bytes.TrimLeft(line, "\t")
+		}
+		if string(line) == h.word {
+			return next
+		}
+		i = next
+	}
+	return len(text)
+}
+
+// isLineComment reports whether a line comment starts at content[i]
+func isLineComment(content []byte, i int, syntax commentSyntax) bool {
+	for _, marker := range syntax.line {
+		if !bytes.HasPrefix(content[i:], []byte(marker)) {
+			continue
+		}
+		if syntax.wordStart && i > 0 && content[i-1] != ' ' && content[i-1] != '\t' && content[i-1] != '\n' {
+			continue
+		}
+		for _, keep := range syntax.keep {
+			if bytes.HasPrefix(content[i:], []byte(keep)) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// stringEnd returns the length of the string literal at the start of text opened by quote, including
+// both quotes; a single-line literal ends at the line break and an unterminated one at the end of text
+func stringEnd(text, quote []byte, escapes, multiline bool) int {
+	for i := len(quote); i < len(text); i++ {
+		switch {
+		case escapes && text[i] == '\\':
+			i++
+		case text[i] == '\n' && !multiline:
+			return i
+		case bytes.HasPrefix(text[i:], quote):
+			return i + len(quote)
+		}
+	}
+	return len(text)
+}
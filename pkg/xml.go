@@ -0,0 +1,102 @@
+package contextify
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// xmlFormatter writes the <documents> structure recommended for long-context prompting, with the
+// preprompt and request in their own tags and each file's content wrapped in CDATA
+type xmlFormatter struct {
+	index          int
+	inDocuments    bool
+	closedSections bool
+}
+
+func (x *xmlFormatter) BeginDocument(w io.Writer) error {
+	return nil
+}
+
+func (x *xmlFormatter) WritePreamble(w io.Writer, p Preamble) error {
+	var b strings.Builder
+	// The request gets its own tag, so the instructions are the preprompt before it was substituted
+	instructions := p.Template
+	if instructions == "" {
+		instructions = p.Preprompt
+	}
+	if instructions = strings.TrimSpace(instructions); instructions != "" {
+		fmt.Fprintf(&b, "<instructions>\n%s\n</instructions>\n", xmlEscape(instructions))
+	}
+	if p.Request != "" {
+		fmt.Fprintf(&b, "<request>\n%s\n</request>\n", xmlEscape(strings.TrimSpace(p.Request)))
+	}
+	if p.Parts > 0 {
+		fmt.Fprintf(&b, "<part number=\"%d\" total=\"%d\"/>\n", p.Part, p.Parts)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (x *xmlFormatter) WriteTree(w io.Writer, lines []string) error {
+	text := "<documents>\n"
+	if lines != nil {
+		text = "<directory_structure>\n" + xmlEscape(strings.Join(lines, "\n")) + "\n</directory_structure>\n" + text
+	}
+	x.inDocuments = true
+	_, err := io.WriteString(w, text)
+	return err
+}
+
+func (x *xmlFormatter) WriteFile(w io.Writer, file File) error {
+	x.index++
+	_, err := fmt.Fprintf(w, "<document index=\"%d\">\n<source>%s</source>\n<document_content>%s</document_content>\n</document>\n",
+		x.index, xmlEscape(file.Label()), xmlCDATA(string(file.Content)))
+	return err
+}
+
+func (x *xmlFormatter) WriteSkipped(w io.Writer, file FileStats) error {
+	return nil
+}
+
+func (x *xmlFormatter) WriteSection(w io.Writer, s Section) error {
+	if err := x.closeDocuments(w); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "<section title=\"%s\">%s</section>\n", xmlEscape(s.Title), xmlCDATA(s.Body))
+	return err
+}
+
+func (x *xmlFormatter) EndDocument(w io.Writer) error {
+	return x.closeDocuments(w)
+}
+
+// closeDocuments ends the <documents> element before the trailing sections
+func (x *xmlFormatter) closeDocuments(w io.Writer) error {
+	if !x.inDocuments {
+		return nil
+	}
+	x.inDocuments = false
+	_, err := io.WriteString(w, "</documents>\n")
+	return err
+}
+
+// xmlEscape escapes text for use in XML character data and attribute values
+func xmlEscape(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;").Replace(validXML(text))
+}
+
+// xmlCDATA wraps text in a CDATA section, splitting it wherever the text itself contains "]]>"
+func xmlCDATA(text string) string {
+	return "<![CDATA[" + strings.ReplaceAll(validXML(text), "]]>", "]]]]><![CDATA[>") + "]]>"
+}
+
+// validXML replaces characters that XML 1.0 does not allow, even in CDATA, with U+FFFD
+func validXML(text string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\n' || r == '\r' || (r >= 0x20 && r <= 0xD7FF) || (r >= 0xE000 && r <= 0xFFFD) || (r >= 0x10000 && r <= 0x10FFFF) {
+			return r
+		}
+		return '\uFFFD'
+	}, text)
+}
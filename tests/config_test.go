@@ -0,0 +1,361 @@
+package test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	contextify "contextify/pkg"
+)
+
+func TestConfigLoaderLayers(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yaml")
+	writeFile(t, configFile, "token_limit: 2000\noutput: out.txt\nomit:\n  - vendor/\nrequest: Fix <it>\n")
+
+	loader := contextify.NewConfigLoader()
+	if err := loader.LoadFile(configFile); err != nil {
+		t.Fatal(err)
+	}
+	env := []string{"CONTEXTIFY_TOKEN_LIMIT=3000", "CONTEXTIFY_INCLUDE=*.go, docs/", "CONTEXTIFY_SKELETON=true", "HOME=/root", "CONTEXTIFY_UNKNOWN=1"}
+	if err := loader.LoadEnv(env); err != nil {
+		t.Fatal(err)
+	}
+	if err := loader.Set("token_limit", 4000, "flag --tokens"); err != nil {
+		t.Fatal(err)
+	}
+
+	config := loader.Resolve()
+	if config.Directory != "." || config.TokenLimit != 4000 || config.Output != "out.txt" || !config.Skeleton {
+		t.Errorf("Unexpected merged config %+v", config)
+	}
+	if !reflect.DeepEqual(config.Omit, []string{"vendor/"}) || !reflect.DeepEqual(config.Include, []string{"*.go", "docs/"}) {
+		t.Errorf("Unexpected lists omit=%v include=%v", config.Omit, config.Include)
+	}
+	if config.Preprompt != strings.Replace(contextify.DefaultPreprompt, "<request>", "Fix <it>", 1) {
+		t.Errorf("Expected the request in the default preprompt, got %q", config.Preprompt)
+	}
+
+	expected := map[string]string{
+		"directory":   contextify.SourceDefault,
+		"token_limit": "flag --tokens",
+		"output":      configFile,
+		"include":     "env CONTEXTIFY_INCLUDE",
+		"skeleton":    "env CONTEXTIFY_SKELETON",
+	}
+	for key, source := range expected {
+		if loader.Sources[key] != source {
+			t.Errorf("Expected %s to come from %q, got %q", key, source, loader.Sources[key])
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := loader.WriteConfig(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"token_limit: 4000  # flag --tokens\n", "omit: [vendor/]  # " + configFile + "\n", "include: ['*.go', docs/]  # env CONTEXTIFY_INCLUDE\n"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Expected config show output to contain %q, got:\n%s", want, buf.String())
+		}
+	}
+
+	if err := loader.LoadEnv([]string{"CONTEXTIFY_PACK=maybe"}); err == nil {
+		t.Error("Expected an error for an invalid boolean")
+	}
+	if err := loader.Set("token_limit", "many", "flag --tokens"); err == nil {
+		t.Error("Expected an error for a value of the wrong type")
+	}
+}
+
+func TestDiscoverConfigFiles(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", home)
+	writeFile(t, filepath.Join(home, "contextify", "config.yml"), "skeleton: true\n")
+
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, ".git", "HEAD"), "ref: refs/heads/main\n")
+	writeFile(t, filepath.Join(dir, ".contextify.yaml"), "token_limit: 1000\n")
+	writeFile(t, filepath.Join(dir, ".contextify.yml"), "token_limit: 9999\n")
+	writeFile(t, filepath.Join(dir, "pkg", ".contextify.yml"), "token_limit: 2000\n")
+	writeFile(t, filepath.Join(dir, "pkg", "api", "api.go"), "package api\n")
+
+	files, err := contextify.DiscoverConfigFiles(filepath.Join(dir, "pkg", "api"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		filepath.Join(home, "contextify", "config.yml"),
+		filepath.Join(dir, ".contextify.yaml"),
+		filepath.Join(dir, "pkg", ".contextify.yml"),
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("Expected %v, got %v", expected, files)
+	}
+
+	loader := contextify.NewConfigLoader()
+	for _, file := range files {
+		if err := loader.LoadFile(file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if config := loader.Resolve(); config.TokenLimit != 2000 || !config.Skeleton {
+		t.Errorf("Expected the nearest project config to win, got %+v", config)
+	}
+
+	// Outside a repository only the directory itself is searched
+	outside := t.TempDir()
+	writeFile(t, filepath.Join(outside, "sub", "a.txt"), "a\n")
+	writeFile(t, filepath.Join(outside, ".contextify.yaml"), "token_limit: 1000\n")
+	if files, err := contextify.DiscoverConfigFiles(filepath.Join(outside, "sub")); err != nil || len(files) != 1 {
+		t.Errorf("Expected only the user config outside a repository, got %v (%v)", files, err)
+	}
+}
+
+func TestProjectConfigRelativePaths(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, ".git", "HEAD"), "ref: refs/heads/main\n")
+	writeFile(t, filepath.Join(dir, ".contextify.yaml"), "directory: .\noutput: out/context.txt\nomit:\n  - /sub/generated/\n  - /top.txt\n  - \"*.log\"\nprofiles:\n  docs:\n    output: docs.txt\n")
+	writeFile(t, filepath.Join(dir, "top.txt"), "top\n")
+	writeFile(t, filepath.Join(dir, "sub", "main.go"), "package main\n")
+	writeFile(t, filepath.Join(dir, "sub", "generated", "gen.go"), "package generated\n")
+
+	// Run from the subdirectory, as a plain contextify there would
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(filepath.Join(dir, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Dir(cwd)
+
+	load := func() *contextify.ConfigLoader {
+		files, err := contextify.DiscoverConfigFiles(".")
+		if err != nil {
+			t.Fatal(err)
+		}
+		loader := contextify.NewConfigLoader()
+		for _, file := range files {
+			if err := loader.LoadProjectFile(file); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return loader
+	}
+
+	config := load().Resolve()
+	if config.Directory != root || config.Output != filepath.Join(root, "out", "context.txt") {
+		t.Errorf("Expected paths relative to the config file, got directory %q and output %q", config.Directory, config.Output)
+	}
+	if expected := []string{"/sub/generated/", "/top.txt", "*.log"}; !reflect.DeepEqual(config.Omit, expected) {
+		t.Errorf("Expected omit %v, got %v", expected, config.Omit)
+	}
+
+	// Anchored patterns follow the processed directory down into the subdirectory
+	loader := load()
+	if err := loader.Set("directory", ".", "flag --directory"); err != nil {
+		t.Fatal(err)
+	}
+	config = loader.Resolve()
+	if expected := []string{"/generated/", "*.log"}; !reflect.DeepEqual(config.Omit, expected) {
+		t.Errorf("Expected omit %v, got %v", expected, config.Omit)
+	}
+	var buf bytes.Buffer
+	if _, err := contextify.ProcessDirectory(config, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "=== File: main.go ===") || strings.Contains(buf.String(), "gen.go") {
+		t.Errorf("Expected generated/ to be omitted, got:\n%s", buf.String())
+	}
+
+	loader = load()
+	if err := loader.ApplyProfile("docs"); err != nil {
+		t.Fatal(err)
+	}
+	if output := loader.Resolve().Output; output != filepath.Join(root, "docs.txt") {
+		t.Errorf("Expected the profile output relative to its config file, got %q", output)
+	}
+
+	// The same file given with --config keeps its paths relative to the current directory
+	loader = contextify.NewConfigLoader()
+	if err := loader.LoadFile(filepath.Join("..", ".contextify.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	config = loader.Resolve()
+	if config.Directory != "." || config.Output != filepath.Join("out", "context.txt") {
+		t.Errorf("Expected --config paths relative to the current directory, got directory %q and output %q", config.Directory, config.Output)
+	}
+	if expected := []string{"/sub/generated/", "/top.txt", "*.log"}; !reflect.DeepEqual(config.Omit, expected) {
+		t.Errorf("Expected omit %v, got %v", expected, config.Omit)
+	}
+}
+
+func TestConfigLoaderProfiles(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yaml")
+	writeFile(t, configFile, `output: out.txt
+token_limit: 1000
+omit:
+  - vendor/
+profile: backend
+profiles:
+  backend:
+    include: ["pkg/**"]
+    output: backend.txt
+  api:
+    extends: backend
+    token_limit: 500
+  loop:
+    extends: loop
+`)
+
+	load := func(profile string) (*contextify.ConfigLoader, error) {
+		loader := contextify.NewConfigLoader()
+		if err := loader.LoadFile(configFile); err != nil {
+			t.Fatal(err)
+		}
+		if profile == "" {
+			profile = loader.Config.Profile
+		}
+		return loader, loader.ApplyProfile(profile)
+	}
+
+	loader, err := load("api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := loader.Resolve()
+	if config.TokenLimit != 500 || config.Output != "backend.txt" || !reflect.DeepEqual(config.Include, []string{"pkg/**"}) || !reflect.DeepEqual(config.Omit, []string{"vendor/"}) {
+		t.Errorf("Unexpected config for the api profile %+v", config)
+	}
+	if loader.Sources["token_limit"] != "profile api" || loader.Sources["output"] != "profile backend" || loader.Sources["omit"] != configFile {
+		t.Errorf("Unexpected sources %v", loader.Sources)
+	}
+
+	// The profile named in the file applies by default
+	if loader, err = load(""); err != nil || loader.Config.TokenLimit != 1000 || loader.Config.Output != "backend.txt" {
+		t.Errorf("Expected the backend profile, got %+v (%v)", loader.Config, err)
+	}
+
+	if _, err := load("loop"); err == nil || !strings.Contains(err.Error(), "extends itself") {
+		t.Errorf("Expected a cycle error, got %v", err)
+	}
+	if _, err := load("frontend"); err == nil || !strings.Contains(err.Error(), "known profiles: api, backend, loop") {
+		t.Errorf("Expected an unknown profile error, got %v", err)
+	}
+
+	writeFile(t, configFile, "profiles:\n  docs:\n    split: true\n")
+	if err := contextify.NewConfigLoader().LoadFile(configFile); err == nil || !strings.Contains(err.Error(), "config.yaml:3:5: unknown field \"split\" in profile \"docs\"") {
+		t.Errorf("Expected an error for a field profiles cannot set, got %v", err)
+	}
+}
+
+func TestConfigLoaderStrict(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yaml")
+	writeFile(t, configFile, "token_limt: 2000\noutput: out.txt\nomits:\n  - vendor/\nprofiles:\n  docs:\n    includes: [docs/]\n")
+	err := contextify.NewConfigLoader().LoadFile(configFile)
+	if err == nil {
+		t.Fatal("Expected errors for unknown fields")
+	}
+	for _, want := range []string{
+		configFile + `:1:1: unknown field "token_limt" (did you mean "token_limit"?)`,
+		configFile + `:3:1: unknown field "omits" (did you mean "omit"?)`,
+		configFile + `:7:5: unknown field "includes" in profile "docs" (did you mean "include"?)`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %q in:\n%v", want, err)
+		}
+	}
+
+	writeFile(t, configFile, "token_limit: many\n")
+	if err := contextify.NewConfigLoader().LoadFile(configFile); err == nil || !strings.Contains(err.Error(), configFile+": line 1: cannot unmarshal") {
+		t.Errorf("Expected a type error with its line, got %v", err)
+	}
+
+	// A zero token limit means the default, as it does for the flag
+	writeFile(t, configFile, "token_limit: 0\noutput: out.txt\n")
+	loader := contextify.NewConfigLoader()
+	if err := loader.LoadFile(configFile); err != nil {
+		t.Fatal(err)
+	}
+	if config := loader.Resolve(); config.TokenLimit != contextify.DefaultTokenLimit {
+		t.Errorf("Expected the default token limit, got %d", config.TokenLimit)
+	}
+	config, err := contextify.LoadConfigFromFlags(configFile, "", "", "", "", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.TokenLimit != contextify.DefaultTokenLimit || config.Directory != "." || config.Preprompt != contextify.DefaultPreprompt {
+		t.Errorf("Expected defaults for fields missing from the config file, got %+v", config)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	dir := t.TempDir()
+	if err := contextify.ValidateConfig(contextify.Config{Directory: dir, TokenLimit: 1000}); err != nil {
+		t.Errorf("Expected a valid config, got %v", err)
+	}
+
+	config := contextify.Config{
+		Directory:       filepath.Join(dir, "missing"),
+		TokenLimit:      -1,
+		LineNumberWidth: 99,
+		OutputFormat:    "html",
+		PackPolicy:      "largest",
+		Staged:          true,
+		Worktree:        true,
+	}
+	err := contextify.ValidateConfig(config)
+	if err == nil {
+		t.Fatal("Expected an invalid config")
+	}
+	for _, want := range []string{"token_limit must be positive", "line_number_width must be between 0 and 20", "does not exist", `unknown output format "html"`, `unknown pack policy "largest"`, "only one of since, staged and worktree"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %q in:\n%v", want, err)
+		}
+	}
+}
+
+func TestReadRequest(t *testing.T) {
+	dir := t.TempDir()
+	requestFile := filepath.Join(dir, "request.md")
+	writeFile(t, requestFile, "Fix the parser\n\n")
+
+	tests := []struct {
+		name        string
+		request     string
+		requestFile string
+		expected    string
+	}{
+		{"flag", "Fix it", "", "Fix it"},
+		{"stdin", "-", "", "Fix the lexer"},
+		{"request file", "", requestFile, "Fix the parser"},
+		{"neither", "", "", ""},
+	}
+	for _, tt := range tests {
+		request, err := contextify.ReadRequest(tt.request, tt.requestFile, strings.NewReader("Fix the lexer\r\n"))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if request != tt.expected {
+			t.Errorf("%s: got %q; want %q", tt.name, request, tt.expected)
+		}
+	}
+
+	if _, err := contextify.ReadRequest("-", requestFile, strings.NewReader("")); err == nil || !strings.Contains(err.Error(), "cannot use --request with --request-file") {
+		t.Errorf("Expected a mutual exclusion error, got %v", err)
+	}
+	if _, err := contextify.ReadRequest("", filepath.Join(dir, "missing.md"), strings.NewReader("")); err == nil {
+		t.Error("Expected an error for a missing request file")
+	}
+}
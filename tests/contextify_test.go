@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	contextify "contextify/pkg"
@@ -132,7 +134,7 @@ func TestProcessDirectory(t *testing.T) {
 		Preprompt:  "Preprompt\n",
 	}
 	var buf bytes.Buffer
-	totalChars, err := contextify.ProcessDirectory(config, &buf)
+	stats, err := contextify.ProcessDirectory(config, &buf)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -141,7 +143,182 @@ func TestProcessDirectory(t *testing.T) {
 	if buf.String() != expected {
 		t.Errorf("Expected output %q, got %q", expected, buf.String())
 	}
-	if totalChars != len(expected) {
-		t.Errorf("Expected totalChars %d, got %d", len(expected), totalChars)
+	if stats.TotalChars != len(expected) {
+		t.Errorf("Expected totalChars %d, got %d", len(expected), stats.TotalChars)
+	}
+}
+
+func TestProcessDirectoryInclude(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "pkg", "a", "a.go"), "package a\n")
+	writeFile(t, filepath.Join(dir, "pkg", "a", "a_test.go"), "package a\n")
+	writeFile(t, filepath.Join(dir, "pkg", "a", "notes.txt"), "notes\n")
+	writeFile(t, filepath.Join(dir, "docs", "guide.md"), "guide\n")
+	writeFile(t, filepath.Join(dir, "docs", "deep", "other.md"), "other\n")
+	writeFile(t, filepath.Join(dir, "cmd", "main.go"), "package main\n")
+	writeFile(t, filepath.Join(dir, "pkg", ".contextifyignore"), "*_test.go\n")
+
+	config := contextify.Config{
+		Directory: dir,
+		Include:   []string{"pkg/**/*.go", "docs/*.md"},
+		Preprompt: "",
+	}
+	var buf bytes.Buffer
+	_, err := contextify.ProcessDirectory(config, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedTree := filepath.Base(dir) + "\n├── docs\n│   └── guide.md\n└── pkg\n    └── a\n        └── a.go\n\n"
+	if !strings.Contains(buf.String(), expectedTree) {
+		t.Errorf("Expected tree %q in output %q", expectedTree, buf.String())
+	}
+	for _, path := range []string{"pkg/a/a.go", "docs/guide.md"} {
+		if !strings.Contains(buf.String(), "=== File: "+filepath.FromSlash(path)+" ===") {
+			t.Errorf("Expected %s to be included", path)
+		}
+	}
+	for _, path := range []string{"pkg/a/a_test.go", "pkg/a/notes.txt", "docs/deep/other.md", "cmd/main.go"} {
+		if strings.Contains(buf.String(), "=== File: "+filepath.FromSlash(path)+" ===") {
+			t.Errorf("Expected %s to be excluded", path)
+		}
+	}
+}
+
+func TestProcessDirectoryGitTracked(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, ".gitignore"), "*.log\n")
+	writeFile(t, filepath.Join(dir, "src", "tracked.go"), "package src\n")
+	writeFile(t, filepath.Join(dir, "untracked.txt"), "untracked\n")
+	writeFile(t, filepath.Join(dir, "debug.log"), "log\n")
+	runGit(t, dir, "init", "-q")
+	runGit(t, dir, "add", ".gitignore", "src/tracked.go")
+
+	process := func(config contextify.Config) string {
+		var buf bytes.Buffer
+		if _, err := contextify.ProcessDirectory(config, &buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	output := process(contextify.Config{Directory: dir, GitTracked: true})
+	expectedTree := filepath.Base(dir) + "\n├── src\n│   └── tracked.go\n└── .gitignore\n\n"
+	if !strings.Contains(output, expectedTree) {
+		t.Errorf("Expected tree %q in output %q", expectedTree, output)
+	}
+	if strings.Contains(output, "untracked.txt") || strings.Contains(output, "debug.log") {
+		t.Errorf("Expected only tracked files, got %q", output)
+	}
+
+	output = process(contextify.Config{Directory: dir, GitTracked: true, GitUntracked: true})
+	if !strings.Contains(output, "=== File: untracked.txt ===") {
+		t.Errorf("Expected untracked file to be included, got %q", output)
+	}
+	if strings.Contains(output, "debug.log") {
+		t.Errorf("Expected ignored file to be excluded, got %q", output)
+	}
+
+	// Outside a repository the walker is used instead
+	plain := t.TempDir()
+	writeFile(t, filepath.Join(plain, "file.txt"), "content\n")
+	output = process(contextify.Config{Directory: plain, GitTracked: true})
+	if !strings.Contains(output, "=== File: file.txt ===") {
+		t.Errorf("Expected fallback to directory walk, got %q", output)
+	}
+}
+
+func runGit(t *testing.T, dir string, args ...string) {
+	t.Helper()
+	cmd := exec.Command("git", append([]string{"-C", dir, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git %v: %v: %s", args, err, out)
+	}
+}
+
+func TestProcessDirectoryDiffScoped(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.txt"), "a\n")
+	writeFile(t, filepath.Join(dir, "b.txt"), "b\n")
+	writeFile(t, filepath.Join(dir, "c.txt"), "c\n")
+	runGit(t, dir, "init", "-q")
+	runGit(t, dir, "add", ".")
+	runGit(t, dir, "commit", "-q", "-m", "initial")
+	runGit(t, dir, "tag", "base")
+	writeFile(t, filepath.Join(dir, "a.txt"), "a changed\n")
+	runGit(t, dir, "commit", "-q", "-am", "change a")
+	writeFile(t, filepath.Join(dir, "b.txt"), "b staged\n")
+	runGit(t, dir, "add", "b.txt")
+	writeFile(t, filepath.Join(dir, "c.txt"), "c unstaged\n")
+
+	tests := []struct {
+		name     string
+		config   contextify.Config
+		included []string
+		excluded []string
+	}{
+		{"since", contextify.Config{Since: "base"}, []string{"a.txt", "b.txt", "c.txt"}, nil},
+		{"staged", contextify.Config{Staged: true}, []string{"b.txt"}, []string{"a.txt", "c.txt"}},
+		{"worktree", contextify.Config{Worktree: true}, []string{"c.txt"}, []string{"a.txt", "b.txt"}},
+	}
+	for _, tt := range tests {
+		tt.config.Directory = dir
+		var buf bytes.Buffer
+		if _, err := contextify.ProcessDirectory(tt.config, &buf); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		for _, path := range tt.included {
+			if !strings.Contains(buf.String(), "=== File: "+path+" ===") {
+				t.Errorf("%s: expected %s to be included", tt.name, path)
+			}
+		}
+		for _, path := range tt.excluded {
+			if strings.Contains(buf.String(), path) {
+				t.Errorf("%s: expected %s to be excluded", tt.name, path)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	_, err := contextify.ProcessDirectory(contextify.Config{Directory: dir, Staged: true, IncludeDiff: true}, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "Diff:\n\ndiff --git a/b.txt b/b.txt") || !strings.Contains(buf.String(), "+b staged") {
+		t.Errorf("Expected staged diff section, got %q", buf.String())
+	}
+
+	_, err = contextify.ProcessDirectory(contextify.Config{Directory: dir, Staged: true, Worktree: true}, &buf)
+	if err == nil {
+		t.Error("Expected an error when combining diff modes")
+	}
+}
+
+func TestProcessDirectoryDiffNothingSelected(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.txt"), "a\n")
+	writeFile(t, filepath.Join(dir, "notes.txt"), "notes\n")
+	runGit(t, dir, "init", "-q")
+	runGit(t, dir, "add", ".")
+	runGit(t, dir, "commit", "-q", "-m", "initial")
+	writeFile(t, filepath.Join(dir, "notes.txt"), "private notes\n")
+
+	// The only change is omitted, so there is nothing to diff
+	var buf bytes.Buffer
+	config := contextify.Config{Directory: dir, Worktree: true, IncludeDiff: true, Omit: []string{"notes.txt"}}
+	if _, err := contextify.ProcessDirectory(config, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "private notes") || strings.Contains(buf.String(), "Diff:") {
+		t.Errorf("Expected no diff for omitted files, got %q", buf.String())
 	}
 }
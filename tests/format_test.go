@@ -0,0 +1,280 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	contextify "contextify/pkg"
+)
+
+func TestDetectLanguage(t *testing.T) {
+	tests := []struct {
+		path     string
+		content  string
+		language string
+	}{
+		{"main.go", "package main\n", "go"},
+		{"web/App.TSX", "", "tsx"},
+		{"Dockerfile", "FROM scratch\n", "dockerfile"},
+		{"bin/run", "#!/usr/bin/env python3\nprint(1)\n", "python"},
+		{"bin/build", "#!/bin/bash\necho hi\n", "bash"},
+		{"bin/serve", "#!/usr/bin/env -S node --inspect\n", "javascript"},
+		{"notes", "just text\n", ""},
+	}
+	for _, tt := range tests {
+		if language := contextify.DetectLanguage(tt.path, []byte(tt.content)); language != tt.language {
+			t.Errorf("DetectLanguage(%q) = %q; want %q", tt.path, language, tt.language)
+		}
+	}
+}
+
+func TestProcessDirectoryMarkdown(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "main.go"), "package main\n")
+	writeFile(t, filepath.Join(dir, "README.md"), "Example:\n\n````go\nfmt.Println(\"```\")\n````\n")
+	writeFile(t, filepath.Join(dir, "run"), "#!/bin/sh\necho hi\n")
+
+	config := contextify.Config{Directory: dir, Preprompt: "Preprompt\n\n", OutputFormat: contextify.FormatMarkdown}
+	var buf bytes.Buffer
+	stats, err := contextify.ProcessDirectory(config, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := buf.String()
+	if stats.TotalChars != len(output) {
+		t.Errorf("Expected TotalChars %d, got %d", len(output), stats.TotalChars)
+	}
+
+	expected := []string{
+		"## Directory structure\n\n```\n" + filepath.Base(dir) + "\n",
+		"## File contents\n\n",
+		"### `main.go`\n\n```go\npackage main\n```\n\n",
+		"### `run`\n\n```bash\n#!/bin/sh\necho hi\n```\n\n",
+		// The fence outgrows the longest backtick run in the file
+		"### `README.md`\n\n`````markdown\nExample:\n\n````go\n",
+		"````\n`````\n\n",
+	}
+	for _, s := range expected {
+		if !strings.Contains(output, s) {
+			t.Errorf("Expected output to contain %q, got:\n%s", s, output)
+		}
+	}
+	if strings.Contains(output, "=== File:") {
+		t.Error("Expected no text format headers in markdown output")
+	}
+
+	config.OutputFormat = "html"
+	if _, err := contextify.ProcessDirectory(config, &bytes.Buffer{}); err == nil {
+		t.Error("Expected an error for an unknown output format")
+	}
+}
+
+func TestProcessDirectoryXML(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.html"), "<b>Tom & Jerry</b>\n")
+	writeFile(t, filepath.Join(dir, "b.txt"), "ends a CDATA ]]> early\n")
+
+	config, err := contextify.LoadConfigFromFlags("", dir, "out.xml", "", "Fix the bug", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.OutputFormat = contextify.FormatXML
+	var buf bytes.Buffer
+	if _, err := contextify.ProcessDirectory(config, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// The output is a sequence of elements, so wrap it to parse it as one document
+	var parsed struct {
+		Instructions string `xml:"instructions"`
+		Request      string `xml:"request"`
+		Tree         string `xml:"directory_structure"`
+		Documents    []struct {
+			Index   int    `xml:"index,attr"`
+			Source  string `xml:"source"`
+			Content string `xml:"document_content"`
+		} `xml:"documents>document"`
+	}
+	if err := xml.Unmarshal([]byte("<root>"+buf.String()+"</root>"), &parsed); err != nil {
+		t.Fatalf("Output is not well-formed XML: %v\n%s", err, buf.String())
+	}
+	if strings.TrimSpace(parsed.Request) != "Fix the bug" || strings.Contains(parsed.Instructions, "Fix the bug") {
+		t.Errorf("Expected the request only in its own tag, got instructions %q and request %q", parsed.Instructions, parsed.Request)
+	}
+
+	// A request word that also appears in the preprompt does not move the slot
+	config, err = contextify.LoadConfigFromFlags("", dir, "out.xml", "", "code", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.OutputFormat = contextify.FormatXML
+	var withCode bytes.Buffer
+	if _, err := contextify.ProcessDirectory(config, &withCode); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(withCode.String(), "context of my code base") || !strings.Contains(withCode.String(), "&lt;request&gt;") ||
+		!strings.Contains(withCode.String(), "<request>\ncode\n</request>") {
+		t.Errorf("Expected the preprompt unchanged apart from its request slot, got:\n%s", withCode.String())
+	}
+
+	if !strings.Contains(parsed.Tree, "a.html") {
+		t.Errorf("Expected the tree in directory_structure, got %q", parsed.Tree)
+	}
+	if len(parsed.Documents) != 2 {
+		t.Fatalf("Expected 2 documents, got %d", len(parsed.Documents))
+	}
+	if d := parsed.Documents[0]; d.Index != 1 || d.Source != "a.html" || d.Content != "<b>Tom & Jerry</b>\n" {
+		t.Errorf("Unexpected first document %+v", d)
+	}
+	if d := parsed.Documents[1]; d.Index != 2 || d.Content != "ends a CDATA ]]> early\n" {
+		t.Errorf("Unexpected second document %+v", d)
+	}
+}
+
+func TestProcessDirectoryJSON(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "main.go"), "package main\n")
+	if err := os.Chmod(filepath.Join(dir, "main.go"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "image.bin"), []byte{0, 1, 2}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("package main\n"))
+
+	type record struct {
+		Type     string   `json:"type"`
+		Request  string   `json:"request"`
+		Tree     []string `json:"tree"`
+		Path     string   `json:"path"`
+		Size     int      `json:"size"`
+		Mode     string   `json:"mode"`
+		Language string   `json:"language"`
+		SHA256   string   `json:"sha256"`
+		Tokens   int      `json:"tokens"`
+		Content  string   `json:"content"`
+		Reason   string   `json:"reason"`
+	}
+	check := func(format string, records []record) {
+		if len(records) != 3 {
+			t.Fatalf("%s: expected header, skipped and file records, got %+v", format, records)
+		}
+		if h := records[0]; h.Type != "header" || h.Request != "Explain" || len(h.Tree) != 3 {
+			t.Errorf("%s: unexpected header %+v", format, h)
+		}
+		if s := records[1]; s.Type != "skipped" || s.Path != "image.bin" || s.Reason != contextify.SkipBinary {
+			t.Errorf("%s: unexpected skipped record %+v", format, s)
+		}
+		f := records[2]
+		if f.Type != "file" || f.Path != "main.go" || f.Size != 13 || f.Mode != "0644" || f.Language != "go" ||
+			f.SHA256 != hex.EncodeToString(sum[:]) || f.Tokens != 3 || f.Content != "package main\n" {
+			t.Errorf("%s: unexpected file record %+v", format, f)
+		}
+	}
+
+	config := contextify.Config{Directory: dir, Preprompt: "Preprompt", Request: "Explain", OutputFormat: contextify.FormatJSON}
+	var buf bytes.Buffer
+	if _, err := contextify.ProcessDirectory(config, &buf); err != nil {
+		t.Fatal(err)
+	}
+	var records []record
+	if err := json.Unmarshal(buf.Bytes(), &records); err != nil {
+		t.Fatalf("json: output is not a JSON array: %v\n%s", err, buf.String())
+	}
+	check("json", records)
+
+	config.OutputFormat = contextify.FormatJSONL
+	buf.Reset()
+	if _, err := contextify.ProcessDirectory(config, &buf); err != nil {
+		t.Fatal(err)
+	}
+	records = nil
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var r record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("jsonl: invalid line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, r)
+	}
+	check("jsonl", records)
+}
+
+// houseFormatter is a minimal custom format that numbers files within each document
+type houseFormatter struct {
+	files int
+}
+
+func (h *houseFormatter) BeginDocument(w io.Writer) error { return writeString(w, "BEGIN\n") }
+func (h *houseFormatter) WritePreamble(w io.Writer, p contextify.Preamble) error {
+	return writeString(w, fmt.Sprintf("PROMPT %s PART %d/%d\n", p.Request, p.Part, p.Parts))
+}
+func (h *houseFormatter) WriteTree(w io.Writer, lines []string) error {
+	return writeString(w, fmt.Sprintf("TREE %d\n", len(lines)))
+}
+func (h *houseFormatter) WriteFile(w io.Writer, file contextify.File) error {
+	h.files++
+	return writeString(w, fmt.Sprintf("FILE %d %s %s\n%s", h.files, file.Label(), file.Language, file.Content))
+}
+func (h *houseFormatter) WriteSkipped(w io.Writer, file contextify.FileStats) error {
+	return writeString(w, fmt.Sprintf("SKIPPED %s %s\n", file.Path, file.Skipped))
+}
+func (h *houseFormatter) WriteSection(w io.Writer, s contextify.Section) error {
+	return writeString(w, "SECTION "+s.Title+"\n")
+}
+func (h *houseFormatter) EndDocument(w io.Writer) error { return writeString(w, "END\n") }
+
+func writeString(w io.Writer, s string) error {
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+func TestRegisterFormatter(t *testing.T) {
+	contextify.RegisterFormatter("house", func() contextify.Formatter { return &houseFormatter{} })
+
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.go"), "package a\n")
+	writeFile(t, filepath.Join(dir, "b.py"), "print(1)\n")
+	if err := ioutil.WriteFile(filepath.Join(dir, "c.bin"), []byte{0, 1}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := contextify.Config{Directory: dir, Request: "Review", OutputFormat: "house"}
+	var buf bytes.Buffer
+	if _, err := contextify.ProcessDirectory(config, &buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := "BEGIN\nPROMPT Review PART 0/0\nTREE 4\nFILE 1 a.go go\npackage a\nFILE 2 b.py python\nprint(1)\nSKIPPED c.bin binary\nEND\n"
+	if buf.String() != expected {
+		t.Errorf("Unexpected output:\n%q\nwant:\n%q", buf.String(), expected)
+	}
+
+	// Each part gets a fresh formatter, so numbering restarts
+	config.TokenLimit = 12
+	parts, _, err := contextify.ProcessDirectoryParts(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) < 2 {
+		t.Fatalf("Expected the output to be split, got %d parts", len(parts))
+	}
+	for i, part := range parts {
+		if !strings.HasPrefix(string(part), fmt.Sprintf("BEGIN\nPROMPT Review PART %d/%d\n", i+1, len(parts))) || !strings.HasSuffix(string(part), "END\n") {
+			t.Errorf("Part %d is not a complete document: %q", i+1, part)
+		}
+		if strings.Contains(string(part), "FILE 2") {
+			t.Errorf("Expected every part to number its files from 1: %q", part)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	contextify "contextify/pkg"
+)
+
+// ignoreCases mirrors the examples in git's gitignore documentation
+var ignoreCases = []struct {
+	patterns []string
+	path     string
+	isDir    bool
+	ignored  bool
+}{
+	// Floating patterns match at any level
+	{[]string{"*.log"}, "debug.log", false, true},
+	{[]string{"*.log"}, "logs/debug.log", false, true},
+	{[]string{"*.log"}, "debug.txt", false, false},
+	{[]string{"foo"}, "a/b/foo", false, true},
+	{[]string{"foo"}, "foobar", false, false},
+
+	// Leading slash anchors to the root
+	{[]string{"/foo"}, "foo", false, true},
+	{[]string{"/foo"}, "a/foo", false, false},
+	{[]string{"/*.c"}, "cat-file.c", false, true},
+	{[]string{"/*.c"}, "mozilla-sha1/sha1.c", false, false},
+
+	// A middle slash anchors too
+	{[]string{"doc/frotz"}, "doc/frotz", false, true},
+	{[]string{"doc/frotz"}, "a/doc/frotz", false, false},
+	{[]string{"doc/*.txt"}, "doc/notes.txt", false, true},
+	{[]string{"doc/*.txt"}, "doc/server/arch.txt", false, false},
+
+	// Trailing slash only matches directories
+	{[]string{"build/"}, "build", true, true},
+	{[]string{"build/"}, "build", false, false},
+	{[]string{"build/"}, "a/build", true, true},
+	{[]string{"frotz/"}, "frotz/a.txt", false, true},
+
+	// Leading "**/" matches in all directories
+	{[]string{"**/foo"}, "foo", false, true},
+	{[]string{"**/foo"}, "a/b/foo", false, true},
+	{[]string{"**/foo/bar"}, "x/foo/bar", false, true},
+	{[]string{"**/build/"}, "src/build", true, true},
+
+	// Trailing "/**" matches everything inside
+	{[]string{"abc/**"}, "abc/x/y", false, true},
+	{[]string{"abc/**"}, "abc", true, false},
+
+	// Inner "/**/" matches zero or more directories
+	{[]string{"a/**/b"}, "a/b", false, true},
+	{[]string{"a/**/b"}, "a/x/b", false, true},
+	{[]string{"a/**/b"}, "a/x/y/b", false, true},
+	{[]string{"a/**/b"}, "c/a/b", false, false},
+
+	// Other consecutive asterisks behave like "*"
+	{[]string{"foo**bar"}, "fooxbar", false, true},
+	{[]string{"foo**bar"}, "foo/bar", false, false},
+
+	// Wildcards never cross a slash
+	{[]string{"a?c"}, "abc", false, true},
+	{[]string{"a?c"}, "a/c", false, false},
+	{[]string{"foo/*"}, "foo/bar/baz", false, true},
+
+	// Bracket expressions
+	{[]string{"file[0-9].txt"}, "file3.txt", false, true},
+	{[]string{"file[0-9].txt"}, "filex.txt", false, false},
+	{[]string{"file[!0-9].txt"}, "filex.txt", false, true},
+	{[]string{"file[!0-9].txt"}, "file3.txt", false, false},
+
+	// Negation and last-match-wins
+	{[]string{"*.log", "!keep.log"}, "keep.log", false, false},
+	{[]string{"*.log", "!keep.log"}, "other.log", false, true},
+	{[]string{"!keep.log", "*.log"}, "keep.log", false, true},
+	{[]string{"/*", "!/foo", "/foo/*", "!/foo/bar"}, "foo/bar", true, false},
+	{[]string{"/*", "!/foo", "/foo/*", "!/foo/bar"}, "foo/baz", true, true},
+	{[]string{"/*", "!/foo", "/foo/*", "!/foo/bar"}, "other", false, true},
+
+	// A file cannot be re-included if its parent directory is excluded
+	{[]string{"build/", "!build/keep.txt"}, "build/keep.txt", false, true},
+
+	// Escaped characters
+	{[]string{`\!important`}, "!important", false, true},
+	{[]string{`\#notes`}, "#notes", false, true},
+	{[]string{`foo\*`}, "foo*", false, true},
+	{[]string{`foo\*`}, "foobar", false, false},
+	{[]string{`trailing\ `}, "trailing ", false, true},
+	{[]string{"spaces   "}, "spaces", false, true},
+
+	// Comments and blank lines are not rules
+	{[]string{"# comment"}, "# comment", false, false},
+	{[]string{""}, "anything", false, false},
+}
+
+func TestIgnoreMatcherConformance(t *testing.T) {
+	for _, tt := range ignoreCases {
+		matcher := contextify.NewIgnoreMatcher(tt.patterns, "test")
+		ignored, _ := matcher.Match(tt.path, tt.isDir)
+		if ignored != tt.ignored {
+			t.Errorf("Match(%q, %v) with %q = %v; want %v", tt.path, tt.isDir, tt.patterns, ignored, tt.ignored)
+		}
+	}
+}
+
+func TestIgnoreMatcherRule(t *testing.T) {
+	matcher := contextify.NewIgnoreMatcher([]string{"*.log", "!keep.log"}, "omit")
+	ignored, rule := matcher.Match("keep.log", false)
+	if ignored {
+		t.Error("Expected keep.log to be re-included")
+	}
+	if rule == nil || rule.Pattern != "!keep.log" || rule.Source != "omit" || !rule.Negate {
+		t.Errorf("Expected deciding rule !keep.log from omit, got %+v", rule)
+	}
+
+	ignored, rule = matcher.Match("notes.txt", false)
+	if ignored || rule != nil {
+		t.Errorf("Expected no rule to match notes.txt, got %+v", rule)
+	}
+}
+
+func TestIgnoreStackLayers(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+	t.Setenv("GIT_CONFIG_GLOBAL", "")
+	writeFile(t, filepath.Join(home, ".config", "git", "ignore"), "*.global\n")
+
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, ".git", "info", "exclude"), "*.excluded\n!*.key\n")
+	writeFile(t, filepath.Join(dir, ".gitignore"), "*.log\n")
+	writeFile(t, filepath.Join(dir, "sub", ".gitignore"), "!keep.log\n/local.txt\n!*.pem\n")
+	writeFile(t, filepath.Join(dir, "sub", ".contextifyignore"), "!*.p12\n")
+
+	tests := []struct {
+		name    string
+		config  contextify.Config
+		path    string
+		ignored bool
+		source  string
+	}{
+		{"root gitignore", contextify.Config{}, "debug.log", true, ".gitignore"},
+		{"nested negation", contextify.Config{}, "sub/keep.log", false, "sub/.gitignore"},
+		{"nested anchored to its directory", contextify.Config{}, "sub/local.txt", true, "sub/.gitignore"},
+		{"nested scoped to its directory", contextify.Config{}, "local.txt", false, ""},
+		{"info exclude", contextify.Config{}, "a.excluded", true, ".git/info/exclude"},
+		{"global excludes", contextify.Config{}, "a.global", true, filepath.Join(home, ".config", "git", "ignore")},
+		{"omit overrides gitignore", contextify.Config{Omit: []string{"!debug.log"}}, "debug.log", false, "omit"},
+		{"no nested", contextify.Config{NoNestedGitignore: true}, "sub/keep.log", true, ".gitignore"},
+		{"no gitignore", contextify.Config{NoGitignore: true}, "debug.log", false, ""},
+		{"no git exclude", contextify.Config{NoGitExclude: true}, "a.excluded", false, ""},
+		{"no global excludes", contextify.Config{NoGlobalExcludes: true}, "a.global", false, ""},
+		{"sensitive default", contextify.Config{}, "certs/server.pem", true, contextify.SensitiveSource},
+		{"sensitive dotenv", contextify.Config{}, ".env.production", true, contextify.SensitiveSource},
+		{"sensitive exception", contextify.Config{}, ".env.example", false, contextify.SensitiveSource},
+		{"sensitive public key", contextify.Config{}, "id_ed25519.pub", false, contextify.SensitiveSource},
+		{"omit overrides sensitive default", contextify.Config{Omit: []string{"!*.pem"}}, "server.pem", false, "omit"},
+		{"contextifyignore overrides sensitive default", contextify.Config{}, "sub/cert.p12", false, "sub/.contextifyignore"},
+		{"gitignore cannot re-include sensitive default", contextify.Config{}, "sub/server.pem", true, contextify.SensitiveSource},
+		{"info exclude cannot re-include sensitive default", contextify.Config{}, "server.key", true, contextify.SensitiveSource},
+		{"no sensitive defaults", contextify.Config{NoSensitiveDefaults: true}, "server.pem", false, ""},
+		{"auto-ignored", contextify.Config{Omit: []string{"!out.txt"}, AutoOmit: []string{"/out.txt"}}, "out.txt", true, contextify.AutoOmitSource},
+	}
+	for _, tt := range tests {
+		tt.config.Directory = dir
+		stack, err := contextify.NewIgnoreStack(tt.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ignored, rule := stack.Match(tt.path, false)
+		if ignored != tt.ignored {
+			t.Errorf("%s: Match(%q) = %v; want %v", tt.name, tt.path, ignored, tt.ignored)
+		}
+		source := ""
+		if rule != nil {
+			source = rule.Source
+		}
+		if source != tt.source {
+			t.Errorf("%s: deciding source = %q; want %q", tt.name, source, tt.source)
+		}
+	}
+}
+
+func TestGlobalExcludesFile(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+	writeFile(t, filepath.Join(home, ".config", "git", "config"), "[core]\n\texcludesFile = ~/xdg.ignore\n")
+	writeFile(t, filepath.Join(home, "custom.gitconfig"), "[user]\n\tname = test\n")
+	writeFile(t, filepath.Join(home, "override.gitconfig"), "[core]\n\texcludesfile = /etc/override.ignore\n")
+
+	tests := []struct {
+		name     string
+		global   string
+		expected string
+	}{
+		{"xdg config", "", filepath.Join(home, "xdg.ignore")},
+		{"GIT_CONFIG_GLOBAL skips the xdg config", filepath.Join(home, "custom.gitconfig"), filepath.Join(home, ".config", "git", "ignore")},
+		{"GIT_CONFIG_GLOBAL", filepath.Join(home, "override.gitconfig"), "/etc/override.ignore"},
+	}
+	for _, tt := range tests {
+		t.Setenv("GIT_CONFIG_GLOBAL", tt.global)
+		if path := contextify.GlobalExcludesFile(nil); path != tt.expected {
+			t.Errorf("%s: GlobalExcludesFile() = %q; want %q", tt.name, path, tt.expected)
+		}
+	}
+}
+
+func TestIgnoreStackSubdirectory(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, ".git", "HEAD"), "ref: refs/heads/main\n")
+	writeFile(t, filepath.Join(dir, ".gitignore"), "pkg/generated/\n")
+
+	stack, err := contextify.NewIgnoreStack(contextify.Config{Directory: filepath.Join(dir, "pkg"), NoGlobalExcludes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ignored, _ := stack.Match("generated", true); !ignored {
+		t.Error("Expected the repository root .gitignore to apply to a subdirectory")
+	}
+}
+
+func TestCheckIgnore(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, ".gitignore"), "*.log\n")
+	writeFile(t, filepath.Join(dir, "sub", ".gitignore"), "*.md\n")
+	writeFile(t, filepath.Join(dir, "sub", "notes.md"), "notes\n")
+	writeFile(t, filepath.Join(dir, "image.bin"), "\x00\x01\x02")
+	writeFile(t, filepath.Join(dir, "main.go"), "package main\n")
+
+	config := contextify.Config{Directory: dir, Include: []string{"*.go", "*.log", "*.bin", "sub/"}}
+	decisions, err := contextify.CheckIgnore(config, []string{"debug.log", filepath.Join("sub", "notes.md"), "image.bin", "main.go", "README", "sub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"debug.log: skipped: .gitignore:1 (*.log)",
+		"sub/notes.md: skipped: sub/.gitignore:1 (*.md)",
+		"image.bin: skipped: binary",
+		"main.go: included",
+		"README: skipped: not matched by include",
+		"sub/: included",
+	}
+	if len(decisions) != len(expected) {
+		t.Fatalf("Expected %d decisions, got %d", len(expected), len(decisions))
+	}
+	for i, d := range decisions {
+		if d.String() != expected[i] {
+			t.Errorf("Expected %q, got %q", expected[i], d.String())
+		}
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -22,6 +22,8 @@ func TestLoadConfigFromFlags(t *testing.T) {
 		Omit:       []string{"omit"},
 		Preprompt:  "preprompt\n\nRequest:\n\nrequest",
 		Request:    "request",
+
+		PrepromptTemplate: "preprompt",
 	}
 	if !reflect.DeepEqual(config, expected) {
 		t.Errorf("Expected config %v, got %v", expected, config)
@@ -52,6 +54,8 @@ request: req`)
 		Omit:       []string{"omit1"},
 		Preprompt:  "preprompt\n\nRequest:\n\nreq", // Corrected to match behavior
 		Request:    "req",
+
+		PrepromptTemplate: "preprompt",
 	}
 	if !reflect.DeepEqual(config, expected) {
 		t.Errorf("Expected config %v, got %v", expected, config)
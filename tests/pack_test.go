@@ -0,0 +1,69 @@
+package test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	contextify "contextify/pkg"
+)
+
+func TestProcessDirectoryPack(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "big.txt"), strings.Repeat("x", 1000))
+	writeFile(t, filepath.Join(dir, "docs", "guide.md"), strings.Repeat("d", 200))
+	writeFile(t, filepath.Join(dir, "pkg", "main.go"), strings.Repeat("m", 200))
+	writeFile(t, filepath.Join(dir, "pkg", "util.go"), strings.Repeat("u", 200))
+	writeFile(t, filepath.Join(dir, "small.txt"), "s")
+	old := time.Now().Add(-time.Hour)
+	for _, name := range []string{"big.txt", "docs/guide.md", "pkg/main.go", "small.txt"} {
+		if err := os.Chtimes(filepath.Join(dir, name), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		config   contextify.Config
+		included []string
+		omitted  []string
+	}{
+		{"priority patterns", contextify.Config{Priority: []string{"docs/"}}, []string{"docs/guide.md", "small.txt"}, []string{"big.txt", "pkg/util.go"}},
+		{"smallest", contextify.Config{PackPolicy: contextify.PackSmallest}, []string{"small.txt"}, []string{"big.txt"}},
+		{"recent", contextify.Config{PackPolicy: contextify.PackRecent}, []string{"pkg/util.go", "docs/guide.md"}, []string{"big.txt", "pkg/main.go"}},
+		{"request", contextify.Config{PackPolicy: contextify.PackRequest, Request: "Refactor main.go please"}, []string{"pkg/main.go", "pkg/util.go"}, []string{"big.txt", "docs/guide.md"}},
+	}
+	for _, tt := range tests {
+		tt.config.Directory = dir
+		tt.config.Pack = true
+		tt.config.TokenLimit = 190
+		var buf bytes.Buffer
+		stats, err := contextify.ProcessDirectory(tt.config, &buf)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if stats.TotalTokens > tt.config.TokenLimit {
+			t.Errorf("%s: output has %d tokens, over the limit of %d", tt.name, stats.TotalTokens, tt.config.TokenLimit)
+		}
+		output := buf.String()
+		trailer := output[strings.Index(output, "Omitted files"):]
+		for _, path := range tt.included {
+			if !strings.Contains(output, "=== File: "+filepath.FromSlash(path)+" ===") {
+				t.Errorf("%s: expected %s to be packed", tt.name, path)
+			}
+		}
+		for _, path := range tt.omitted {
+			if strings.Contains(output, "=== File: "+filepath.FromSlash(path)+" ===") || !strings.Contains(trailer, "- "+filepath.FromSlash(path)+" (") {
+				t.Errorf("%s: expected %s to be listed as omitted", tt.name, path)
+			}
+		}
+	}
+
+	_, err := contextify.ProcessDirectory(contextify.Config{Directory: dir, Pack: true, TokenLimit: 190, PackPolicy: "largest"}, &bytes.Buffer{})
+	if err == nil {
+		t.Error("Expected an error for an unknown pack policy")
+	}
+}
@@ -0,0 +1,104 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	contextify "contextify/pkg"
+)
+
+func TestProcessDirectoryStats(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.txt"), "one\ntwo\n")
+	writeFile(t, filepath.Join(dir, "sub", "b.txt"), "three four five six seven eight nine ten\nlast")
+	writeFile(t, filepath.Join(dir, "sub", "c.bin"), "\x00\x01")
+
+	var buf bytes.Buffer
+	stats, err := contextify.ProcessDirectory(contextify.Config{Directory: dir}, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.TotalChars != buf.Len() {
+		t.Errorf("Expected TotalChars %d, got %d", buf.Len(), stats.TotalChars)
+	}
+
+	byPath := map[string]contextify.FileStats{}
+	for _, f := range stats.Files {
+		byPath[filepath.ToSlash(f.Path)] = f
+	}
+	if f := byPath["a.txt"]; f.Bytes != 8 || f.Lines != 2 || f.Tokens == 0 || f.Skipped != "" {
+		t.Errorf("Unexpected stats for a.txt: %+v", f)
+	}
+	if f := byPath["sub/b.txt"]; f.Lines != 2 {
+		t.Errorf("Expected a final line without newline to be counted, got %+v", f)
+	}
+	if f := byPath["sub/c.bin"]; f.Skipped != contextify.SkipBinary {
+		t.Errorf("Expected binary file to be skipped, got %+v", f)
+	}
+
+	dirs := stats.Directories()
+	if len(dirs) != 2 || dirs[0].Path != "." || dirs[0].Files != 2 || dirs[1].Path != "sub" || dirs[1].Files != 1 {
+		t.Errorf("Unexpected directory rollup %+v", dirs)
+	}
+
+	var text bytes.Buffer
+	if err := contextify.WriteReport(&text, stats, contextify.ReportText); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Tokens", "Directory", "Skipped:", "(binary)"} {
+		if !strings.Contains(text.String(), want) {
+			t.Errorf("Expected text report to contain %q, got %q", want, text.String())
+		}
+	}
+
+	var jsonReport bytes.Buffer
+	if err := contextify.WriteReport(&jsonReport, stats, contextify.ReportJSON); err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		TotalTokens int                         `json:"total_tokens"`
+		Files       []contextify.FileStats      `json:"files"`
+		Directories []contextify.DirectoryStats `json:"directories"`
+	}
+	if err := json.Unmarshal(jsonReport.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.TotalTokens != stats.TotalTokens || len(decoded.Files) != 3 || len(decoded.Directories) != 2 {
+		t.Errorf("Unexpected JSON report %s", jsonReport.String())
+	}
+	if decoded.Files[0].Path != filepath.Join("sub", "b.txt") {
+		t.Errorf("Expected files sorted by tokens, got %+v", decoded.Files)
+	}
+
+	if err := contextify.WriteReport(&text, stats, "csv"); err == nil {
+		t.Error("Expected an error for an unknown report format")
+	}
+}
+
+func TestWriteSelection(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.txt"), "one\ntwo\n")
+	writeFile(t, filepath.Join(dir, "c.bin"), "\x00\x01")
+
+	stats, err := contextify.ProcessDirectory(contextify.Config{Directory: dir}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := contextify.WriteSelection(&buf, stats, 10); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{"  a.txt\n", "2  c.bin (skipped: binary)\n", "1 files selected, 1 skipped\n", "Token limit: 10 (exceeds by"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected selection to contain %q, got:\n%s", want, out)
+		}
+	}
+	if strings.Index(out, "a.txt") > strings.Index(out, "c.bin") {
+		t.Errorf("Expected files in output order, got:\n%s", out)
+	}
+}
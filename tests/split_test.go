@@ -0,0 +1,88 @@
+package test
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	contextify "contextify/pkg"
+)
+
+func TestPartPath(t *testing.T) {
+	if p := contextify.PartPath(filepath.Join("out", "output.txt"), 2); p != filepath.Join("out", "output.part2.txt") {
+		t.Errorf("Unexpected part path %s", p)
+	}
+	if p := contextify.PartPath("output", 1); p != "output.part1" {
+		t.Errorf("Unexpected part path %s", p)
+	}
+}
+
+func TestProcessDirectoryParts(t *testing.T) {
+	dir := t.TempDir()
+	for i := 1; i <= 4; i++ {
+		writeFile(t, filepath.Join(dir, fmt.Sprintf("file%d.txt", i)), strings.Repeat(fmt.Sprintf("small %d\n", i), 40))
+	}
+	var huge strings.Builder
+	for i := 1; i <= 200; i++ {
+		fmt.Fprintf(&huge, "huge line %d\n", i)
+	}
+	writeFile(t, filepath.Join(dir, "huge.txt"), huge.String())
+
+	config := contextify.Config{Directory: dir, Preprompt: "Preprompt\n", TokenLimit: 300}
+	parts, stats, err := contextify.ProcessDirectoryParts(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) < 3 {
+		t.Fatalf("Expected the output to be split, got %d parts", len(parts))
+	}
+
+	tokenizer, _ := contextify.NewTokenizer("")
+	total := 0
+	for i, part := range parts {
+		text := string(part)
+		total += len(part)
+		if tokens := tokenizer.CountTokens(text); tokens > config.TokenLimit {
+			t.Errorf("Part %d has %d tokens, over the limit of %d", i+1, tokens, config.TokenLimit)
+		}
+		if !strings.HasPrefix(text, "\ufeffPreprompt\n"+fmt.Sprintf("[Part %d of %d]", i+1, len(parts))) {
+			t.Errorf("Part %d is missing the preprompt or marker: %q", i+1, text)
+		}
+		if strings.Contains(text, "Directory structure:") != (i == 0) {
+			t.Errorf("Part %d: the tree should only be in the first part", i+1)
+		}
+	}
+	if stats.TotalChars != total {
+		t.Errorf("Expected TotalChars %d, got %d", total, stats.TotalChars)
+	}
+
+	// Small files are never broken, the oversized one is split by lines
+	all := string(joinParts(parts))
+	for i := 1; i <= 4; i++ {
+		if strings.Count(all, fmt.Sprintf("small %d\n", i)) != 40 || !strings.Contains(all, fmt.Sprintf("=== File: file%d.txt ===\n", i)) {
+			t.Errorf("Expected file%d.txt to appear whole", i)
+		}
+	}
+	if !strings.Contains(all, "=== File: huge.txt (lines 1-") || strings.Count(all, "huge line") != 200 {
+		t.Errorf("Expected huge.txt to be split into line ranges without losing lines")
+	}
+
+	// Output that fits stays in one part without a marker
+	config.TokenLimit = contextify.DefaultTokenLimit
+	parts, _, err = contextify.ProcessDirectoryParts(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 1 || strings.Contains(string(parts[0]), "[Part") {
+		t.Errorf("Expected a single unmarked part, got %d", len(parts))
+	}
+}
+
+func joinParts(parts [][]byte) []byte {
+	var all []byte
+	for _, part := range parts {
+		all = append(all, part...)
+	}
+	return all
+}
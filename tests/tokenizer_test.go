@@ -0,0 +1,34 @@
+package test
+
+import (
+	"testing"
+
+	contextify "contextify/pkg"
+)
+
+func TestTokenizers(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		expected int
+	}{
+		{"", "hello world!", 3},
+		{contextify.TokenizerHeuristic, "hello world!", 3},
+		{contextify.TokenizerCL100K, "hello world", 2},
+		{contextify.TokenizerCL100K, "tiktoken is great!", 6},
+		{contextify.TokenizerO200K, "hello world", 2},
+	}
+	for _, tt := range tests {
+		tokenizer, err := contextify.NewTokenizer(tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count := tokenizer.CountTokens(tt.text); count != tt.expected {
+			t.Errorf("%s.CountTokens(%q) = %d; want %d", tokenizer.Name(), tt.text, count, tt.expected)
+		}
+	}
+
+	if _, err := contextify.NewTokenizer("gpt2"); err == nil {
+		t.Error("Expected an error for an unknown tokenizer")
+	}
+}
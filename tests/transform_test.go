@@ -0,0 +1,192 @@
+package test
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	contextify "contextify/pkg"
+)
+
+func TestProcessDirectoryLineNumbers(t *testing.T) {
+	dir := t.TempDir()
+	var content strings.Builder
+	for i := 1; i <= 12; i++ {
+		fmt.Fprintf(&content, "line %d\n", i)
+	}
+	writeFile(t, filepath.Join(dir, "a.txt"), content.String())
+
+	plain, err := contextify.ProcessDirectory(contextify.Config{Directory: dir}, &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		config   contextify.Config
+		expected []string
+	}{
+		{contextify.Config{LineNumbers: true}, []string{"=== File: a.txt ===\n 1 | line 1\n 2 | line 2\n", "12 | line 12\n\n"}},
+		{contextify.Config{LineNumbers: true, LineNumberWidth: 4, LineNumberSeparator: ": "}, []string{"\n   1: line 1\n", "  12: line 12\n"}},
+	}
+	for _, tt := range tests {
+		tt.config.Directory = dir
+		var buf bytes.Buffer
+		stats, err := contextify.ProcessDirectory(tt.config, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range tt.expected {
+			if !strings.Contains(buf.String(), s) {
+				t.Errorf("Expected output to contain %q, got:\n%s", s, buf.String())
+			}
+		}
+		if stats.TotalChars != buf.Len() {
+			t.Errorf("Expected TotalChars %d, got %d", buf.Len(), stats.TotalChars)
+		}
+		if stats.Files[0].Tokens <= plain.Files[0].Tokens || stats.Files[0].Bytes != plain.Files[0].Bytes {
+			t.Errorf("Expected numbering to add tokens but not change the file size, got %+v vs %+v", stats.Files[0], plain.Files[0])
+		}
+	}
+}
+
+func TestProcessDirectorySkeleton(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "server.go"), `package server
+
+import "fmt"
+
+// Server answers requests
+type Server struct {
+	Name string // Shown in greetings
+}
+
+// Greet returns a greeting
+func (s *Server) Greet(who string) string {
+	// Build the greeting from parts
+	greeting := fmt.Sprintf("hello %s from %s", who, s.Name)
+	return greeting
+}
+`)
+	writeFile(t, filepath.Join(dir, "broken.go"), "package broken\n\nfunc Oops( {\n\tinternal()\n}\n")
+	writeFile(t, filepath.Join(dir, "notes.txt"), "func Keep() { body() }\n")
+
+	var buf bytes.Buffer
+	stats, err := contextify.ProcessDirectory(contextify.Config{Directory: dir, Skeleton: true}, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := buf.String()
+	for _, s := range []string{
+		"package server\n",
+		"import \"fmt\"\n",
+		"// Server answers requests\ntype Server struct {\n\tName string // Shown in greetings\n}\n",
+		"// Greet returns a greeting\nfunc (s *Server) Greet(who string) string\n",
+		"func Oops( {\n\tinternal()\n}\n",
+		"func Keep() { body() }\n",
+	} {
+		if !strings.Contains(output, s) {
+			t.Errorf("Expected output to contain %q, got:\n%s", s, output)
+		}
+	}
+	for _, s := range []string{"Build the greeting", "Sprintf"} {
+		if strings.Contains(output, s) {
+			t.Errorf("Expected function bodies to be elided, found %q", s)
+		}
+	}
+
+	saved := map[string]int{}
+	for _, f := range stats.Files {
+		saved[f.Path] = f.SavedTokens
+	}
+	if saved["server.go"] <= 0 || saved["broken.go"] != 0 || saved["notes.txt"] != 0 || stats.SavedTokens() != saved["server.go"] {
+		t.Errorf("Unexpected token savings %v", saved)
+	}
+	var report bytes.Buffer
+	if err := contextify.WriteReport(&report, stats, contextify.ReportText); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(report.String(), fmt.Sprintf("Saved by transforms: %d tokens", stats.SavedTokens())) {
+		t.Errorf("Expected the report to show the savings, got:\n%s", report.String())
+	}
+}
+
+func TestProcessDirectoryStripComments(t *testing.T) {
+	tests := []struct {
+		path     string
+		content  string
+		expected string
+	}{
+		{
+			"main.go",
+			"//go:build linux\n\n// Package main runs\npackage main\n\n\n\n/* block\n   comment */\nfunc main() {\n\ts := \"// kept\" + `/* kept */` // dropped\n\tr := '\"' /* dropped */\n}\n",
+			"//go:build linux\n\npackage main\n\nfunc main() {\n\ts := \"// kept\" + `/* kept */`\n\tr := '\"'\n}\n",
+		},
+		{
+			"app.ts",
+			"const url = `http://${host}` // dropped\n/** Docs */\nexport const x = '/* kept */'\n",
+			"const url = `http://${host}`\nexport const x = '/* kept */'\n",
+		},
+		{
+			"tool.py",
+			"#!/usr/bin/env python3\n# dropped\nx = \"# kept\"  # dropped\ns = '''\n# kept in a docstring\n'''\n",
+			"#!/usr/bin/env python3\nx = \"# kept\"\ns = '''\n# kept in a docstring\n'''\n",
+		},
+		{
+			"run.sh",
+			"#!/bin/sh\n# dropped\necho ${#args} $# \"a # b\" # dropped\n",
+			"#!/bin/sh\necho ${#args} $# \"a # b\"\n",
+		},
+		{
+			"heredoc.sh",
+			"cat <<EOF # dropped\n# heredoc line\n\n\nEOF\ncat <<-'END'\n\t# quoted $body\n\tEND\necho $((1<<2)) # dropped\n",
+			"cat <<EOF\n# heredoc line\n\n\nEOF\ncat <<-'END'\n\t# quoted $body\n\tEND\necho $((1<<2))\n",
+		},
+		{
+			"config.yaml",
+			"# dropped\nkey: value # dropped\nurl: http://host/#anchor\n",
+			"key: value\nurl: http://host/#anchor\n",
+		},
+		{
+			"Query.java",
+			"class Query {\n    String sql = \"\"\"\n        /* hint */ SELECT 1\n        -- see http://docs/x\n        \"\"\"; // dropped\n}\n",
+			"class Query {\n    String sql = \"\"\"\n        /* hint */ SELECT 1\n        -- see http://docs/x\n        \"\"\";\n}\n",
+		},
+		{
+			"raw.cpp",
+			"auto s = R\"(\n// kept?\n)\"; // dropped\nauto t = R\"x(a)\" // )x\"; /* dropped */\n",
+			"auto s = R\"(\n// kept?\n)\";\nauto t = R\"x(a)\" // )x\";\n",
+		},
+		{
+			"lib.rs",
+			"fn f<'a>() -> &'a str {\n    \"first\n// second\" // dropped\n}\n",
+			"fn f<'a>() -> &'a str {\n    \"first\n// second\"\n}\n",
+		},
+		{
+			"release.yml",
+			"notes: |\n  # Release notes\n  Use color #fff for the header\n\n# dropped\nkey: value # dropped\nlist:\n  - >- # dropped\n    folded # kept\n",
+			"notes: |\n  # Release notes\n  Use color #fff for the header\n\nkey: value\nlist:\n  - >-\n    folded # kept\n",
+		},
+		{
+			"notes.txt",
+			"# kept\n\n\n// kept\n",
+			"# kept\n\n\n// kept\n",
+		},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		writeFile(t, filepath.Join(dir, tt.path), tt.content)
+		var buf bytes.Buffer
+		stats, err := contextify.ProcessDirectory(contextify.Config{Directory: dir, StripComments: true}, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(buf.String(), "=== File: "+tt.path+" ===\n"+tt.expected+"\n\n") {
+			t.Errorf("%s: expected content %q, got:\n%s", tt.path, tt.expected, buf.String())
+		}
+		if saved := stats.Files[0].SavedTokens; (tt.content != tt.expected) != (saved > 0) {
+			t.Errorf("%s: unexpected saved tokens %d", tt.path, saved)
+		}
+	}
+}